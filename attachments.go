@@ -0,0 +1,363 @@
+// attachments.go
+//
+// This file handles images and files attached to jots. Uploads are checked
+// and processed before the jot is saved: images are re-encoded (which strips
+// their EXIF metadata) and get a thumbnail for the timeline, other files are
+// limited to a few harmless types and stored as they are. Every user has a
+// storage quota covering all of their attachments.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Attachment kinds, as stored in attachments.kind
+const (
+	AttachmentImage = "image"
+	AttachmentFile  = "file"
+)
+
+// Attachment limits
+const (
+	maxAttachments        = 4         // Per jot
+	maxAttachmentBytes    = 10 << 20  // Per upload (10 MB)
+	attachmentQuota       = 100 << 20 // Per user, over all their attachments (100 MB)
+	maxAltTextLength      = 500
+	maxFilenameLength     = 255
+	thumbnailPixels       = 400 // Longest side of image thumbnails
+	attachmentJPEGQuality = 90
+)
+
+// attachmentFileTypes maps the non-image content types accepted as
+// attachments to the extension they are stored with.
+var attachmentFileTypes = map[string]string{
+	"application/pdf":           ".pdf",
+	"text/plain; charset=utf-8": ".txt",
+	"application/zip":           ".zip",
+}
+
+// Attachment is an image or file attached to a jot.
+type Attachment struct {
+	ID          int
+	Kind        string // AttachmentImage or AttachmentFile
+	Filename    string // Name of the uploaded file, shown for files
+	ContentType string // Type of the stored file
+	Size        int    // Size of the stored file in bytes
+	Width       int    // Image width in pixels, 0 for files
+	Height      int    // Image height in pixels, 0 for files
+	AltText     string // Description of an image for screen readers
+	Key         string // Blob key of the stored file
+	ThumbKey    string // Blob key of the thumbnail, empty for files
+
+	data, thumb []byte // Processed contents, only set until PrepareAttachments stores them
+}
+
+// AttachmentUpload is a file submitted with a new jot.
+type AttachmentUpload struct {
+	Filename string
+	AltText  string
+	File     io.Reader
+}
+
+// IsImage reports whether the attachment is an image.
+func (a Attachment) IsImage() bool {
+	return a.Kind == AttachmentImage
+}
+
+// URL returns the address of the stored file.
+func (a Attachment) URL() string {
+	return blobs.URL(a.Key)
+}
+
+// ThumbURL returns the address of the image's thumbnail.
+func (a Attachment) ThumbURL() string {
+	return blobs.URL(a.ThumbKey)
+}
+
+// SizeLabel describes the file size for display, e.g. "1.5 MB".
+func (a Attachment) SizeLabel() string {
+	switch {
+	case a.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1<<20))
+	case a.Size >= 1<<10:
+		return fmt.Sprintf("%d KB", a.Size>>10)
+	}
+	return fmt.Sprintf("%d bytes", a.Size)
+}
+
+// PrepareAttachments checks and processes a user's uploads and stores them,
+// ready to be linked to a jot by SaveContentToDB. It returns an *UploadError
+// if any upload is rejected or the user's quota would be exceeded, in which
+// case nothing is stored. If the jot is not saved afterwards, the caller
+// should remove the files again with DeleteAttachmentFiles. The quota is
+// checked again when the jot is saved.
+func PrepareAttachments(userID int, uploads []AttachmentUpload) ([]Attachment, error) {
+	if len(uploads) == 0 {
+		return nil, nil
+	}
+	if len(uploads) > maxAttachments {
+		return nil, &UploadError{fmt.Sprintf("A jot can have at most %d attachments", maxAttachments)}
+	}
+
+	var attachments []Attachment
+	total := 0
+	for _, upload := range uploads {
+		attachment, err := processAttachment(upload)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+		total += attachment.Size
+	}
+
+	used, err := attachmentUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+	if used+total > attachmentQuota {
+		return nil, quotaError(used)
+	}
+
+	for i := range attachments {
+		if err := storeAttachment(userID, &attachments[i]); err != nil {
+			DeleteAttachmentFiles(attachments[:i+1])
+			return nil, err
+		}
+	}
+	return attachments, nil
+}
+
+// processAttachment validates one upload and prepares the files to store for it.
+func processAttachment(upload AttachmentUpload) (Attachment, error) {
+	attachment := Attachment{Filename: cleanFilename(upload.Filename)}
+	attachment.AltText = strings.TrimSpace(upload.AltText)
+	if utf8.RuneCountInString(attachment.AltText) > maxAltTextLength {
+		return attachment, &UploadError{fmt.Sprintf("Alt text must be at most %d characters", maxAltTextLength)}
+	}
+
+	data, err := readUpload(upload.File, maxAttachmentBytes)
+	if err != nil {
+		return attachment, err
+	}
+
+	contentType := http.DetectContentType(data)
+	if _, ok := imageTypes[contentType]; !ok {
+		if _, ok := attachmentFileTypes[contentType]; !ok {
+			return attachment, &UploadError{"Attachments must be images (PNG, JPEG, GIF or WebP), PDFs, text files or ZIP archives"}
+		}
+		attachment.Kind = AttachmentFile
+		attachment.ContentType = contentType
+		attachment.data = data
+		attachment.Size = len(data)
+		return attachment, nil
+	}
+
+	// Images are re-encoded: JPEGs stay JPEGs, everything else becomes a PNG.
+	// Animated GIFs keep their first frame.
+	img, err := decodeImage(data)
+	if err != nil {
+		return attachment, err
+	}
+	encode := encodePNG
+	attachment.ContentType = "image/png"
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+		encode = func(img image.Image) ([]byte, error) { return encodeJPEG(img, attachmentJPEGQuality) }
+		attachment.ContentType = "image/jpeg"
+	}
+
+	attachment.Kind = AttachmentImage
+	attachment.Width, attachment.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	if attachment.data, err = encode(img); err != nil {
+		log.Printf("Error encoding attachment: %v", err)
+		return attachment, err
+	}
+	if attachment.thumb, err = encode(fitWithin(img, thumbnailPixels)); err != nil {
+		log.Printf("Error encoding thumbnail: %v", err)
+		return attachment, err
+	}
+	attachment.Size = len(attachment.data)
+	return attachment, nil
+}
+
+// cleanFilename keeps the base name of an uploaded file without control characters.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		name = ""
+	}
+	if utf8.RuneCountInString(name) > maxFilenameLength {
+		name = string([]rune(name)[:maxFilenameLength])
+	}
+	return name
+}
+
+// quotaError reports that new attachments don't fit in the quota next to the
+// used bytes.
+func quotaError(used int) *UploadError {
+	return &UploadError{fmt.Sprintf("These attachments would exceed your %d MB storage quota (%.1f MB used)", attachmentQuota>>20, float64(used)/(1<<20))}
+}
+
+// attachmentUsage returns how many bytes of attachments a user has stored.
+func attachmentUsage(userID int) (int, error) {
+	var used int
+	err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM attachments WHERE user_id = ?", userID).Scan(&used)
+	if err != nil {
+		log.Printf("Error retrieving attachment usage: %v", err)
+	}
+	return used, err
+}
+
+// storeAttachment saves a processed attachment and its thumbnail to the blob
+// store under a fresh random key, and sets its keys.
+func storeAttachment(userID int, attachment *Attachment) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating attachment key: %v", err)
+		return err
+	}
+	base := fmt.Sprintf("attachments/%d/%s", userID, hex.EncodeToString(buf))
+
+	ext := attachmentFileTypes[attachment.ContentType]
+	if attachment.IsImage() {
+		ext = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}[attachment.ContentType]
+	}
+	if err := blobs.Put(base+ext, bytes.NewReader(attachment.data), attachment.ContentType); err != nil {
+		return err
+	}
+	attachment.Key = base + ext
+
+	if attachment.IsImage() {
+		if err := blobs.Put(base+"-thumb"+ext, bytes.NewReader(attachment.thumb), attachment.ContentType); err != nil {
+			return err
+		}
+		attachment.ThumbKey = base + "-thumb" + ext
+	}
+	attachment.data, attachment.thumb = nil, nil
+	return nil
+}
+
+// DeleteAttachmentFiles removes stored attachment files from the blob store.
+// Failures are only logged: a leftover file wastes space but breaks nothing.
+func DeleteAttachmentFiles(attachments []Attachment) {
+	for _, attachment := range attachments {
+		for _, key := range []string{attachment.Key, attachment.ThumbKey} {
+			if key != "" {
+				blobs.Delete(key)
+			}
+		}
+	}
+}
+
+// saveAttachments links stored attachments to a jot being saved in tx. The
+// quota is checked again with the user's row locked: PrepareAttachments only
+// reads the usage, so two jots uploaded at once could both pass it. The usage
+// is read with a locking read, which sees the latest committed attachments.
+func saveAttachments(tx *sql.Tx, jotID int64, userID int, attachments []Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	var locked int
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&locked); err != nil {
+		log.Printf("Error locking user: %v", err)
+		return err
+	}
+	var used int
+	err := tx.QueryRow("SELECT COALESCE(SUM(size), 0) FROM attachments WHERE user_id = ? LOCK IN SHARE MODE", userID).Scan(&used)
+	if err != nil {
+		log.Printf("Error retrieving attachment usage: %v", err)
+		return err
+	}
+	total := 0
+	for _, attachment := range attachments {
+		total += attachment.Size
+	}
+	if used+total > attachmentQuota {
+		return quotaError(used)
+	}
+
+	for i, attachment := range attachments {
+		_, err := tx.Exec(`
+            INSERT INTO attachments (content_id, user_id, position, kind, filename, content_type, size, width, height, alt_text, blob_key, thumb_key)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `, jotID, userID, i, attachment.Kind, attachment.Filename, attachment.ContentType, attachment.Size,
+			attachment.Width, attachment.Height, attachment.AltText, attachment.Key, attachment.ThumbKey)
+		if err != nil {
+			log.Printf("Error saving attachment: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// AttachAttachments fills in the Attachments of every jot with a single query.
+func AttachAttachments(jots []*Jot) error {
+	if len(jots) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(jots))
+	for i, jot := range jots {
+		ids[i] = jot.ID
+	}
+	byJot, err := fetchAttachments(ids)
+	if err != nil {
+		return err
+	}
+	for _, jot := range jots {
+		jot.Attachments = byJot[jot.ID]
+	}
+	return nil
+}
+
+// fetchAttachments loads the attachments of the given jots, keyed by jot ID, in upload order.
+func fetchAttachments(jotIDs []int) (map[int][]Attachment, error) {
+	placeholders, args := inClause(jotIDs)
+	rows, err := db.Query(`
+        SELECT content_id, id, kind, filename, content_type, size, width, height, alt_text, blob_key, thumb_key
+        FROM attachments
+        WHERE content_id IN (`+placeholders+`)
+        ORDER BY content_id, position
+    `, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	byJot := make(map[int][]Attachment)
+	for rows.Next() {
+		var jotID int
+		var a Attachment
+		err := rows.Scan(&jotID, &a.ID, &a.Kind, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height, &a.AltText, &a.Key, &a.ThumbKey)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		byJot[jotID] = append(byJot[jotID], a)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return byJot, nil
+}
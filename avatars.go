@@ -0,0 +1,206 @@
+// avatars.go
+//
+// This file handles profile pictures. An uploaded avatar is cropped to a
+// centered square and resized into every size in avatarSizes, and the
+// results are saved to the blob store under a fresh key, so a new upload
+// never reuses a cached URL. Users without an upload get an identicon: a
+// symmetric 5x5 pattern generated from their username, which always looks
+// the same for the same user.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"net/url"
+)
+
+// avatarSize is one of the sizes avatars are stored and shown in.
+type avatarSize struct {
+	Name   string // Used in templates and blob keys
+	Pixels int    // Width and height
+}
+
+// avatarSizes lists the sizes every avatar is resized to.
+var avatarSizes = []avatarSize{
+	{"small", 48},
+	{"medium", 128},
+	{"large", 256},
+}
+
+// Avatar upload limits
+const (
+	maxAvatarBytes  = 5 << 20 // Largest accepted upload (5 MB)
+	minAvatarPixels = 32      // Smallest accepted width and height
+)
+
+// avatarSizePixels returns the pixel size of a named avatar size, or 0 if there is no such size.
+func avatarSizePixels(name string) int {
+	for _, size := range avatarSizes {
+		if size.Name == name {
+			return size.Pixels
+		}
+	}
+	return 0
+}
+
+// AvatarURL returns the address of a user's avatar in the given size: their
+// uploaded picture if they have one, or their identicon.
+func AvatarURL(username, avatarKey, size string) string {
+	if avatarSizePixels(size) == 0 {
+		size = "medium"
+	}
+	if avatarKey != "" {
+		return blobs.URL(avatarKey + "/" + size + ".png")
+	}
+	return "/identicons/" + size + "/" + url.PathEscape(username) + ".png"
+}
+
+// SaveAvatar validates an uploaded image, stores it in every avatar size and
+// makes it the user's avatar, replacing any previous upload. It returns an
+// *UploadError if the upload is not an acceptable image.
+func SaveAvatar(userID int, upload io.Reader) error {
+	data, err := readUpload(upload, maxAvatarBytes)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	// Turn phone photos upright before cropping, since the EXIF tag is dropped
+	img = applyOrientation(img, jpegOrientation(data))
+	if bounds := img.Bounds(); bounds.Dx() < minAvatarPixels || bounds.Dy() < minAvatarPixels {
+		return &UploadError{fmt.Sprintf("Avatars must be at least %dx%d pixels", minAvatarPixels, minAvatarPixels)}
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating avatar key: %v", err)
+		return err
+	}
+	key := fmt.Sprintf("avatars/%d/%s", userID, hex.EncodeToString(buf))
+
+	square := cropSquare(img)
+	for _, size := range avatarSizes {
+		encoded, err := encodePNG(resizeImage(square, size.Pixels, size.Pixels))
+		if err != nil {
+			log.Printf("Error encoding avatar: %v", err)
+			deleteAvatarFiles(key)
+			return err
+		}
+		if err = blobs.Put(key+"/"+size.Name+".png", bytes.NewReader(encoded), "image/png"); err != nil {
+			deleteAvatarFiles(key)
+			return err
+		}
+	}
+
+	return setAvatarKey(userID, key)
+}
+
+// RemoveAvatar deletes a user's uploaded avatar, so their identicon is shown again.
+func RemoveAvatar(userID int) error {
+	return setAvatarKey(userID, "")
+}
+
+// setAvatarKey points a user's profile at a new set of avatar files and
+// deletes the files of the previous avatar.
+func setAvatarKey(userID int, key string) error {
+	var oldKey string
+	err := db.QueryRow("SELECT avatar_key FROM users WHERE id = ?", userID).Scan(&oldKey)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error retrieving avatar: %v", err)
+		return err
+	}
+
+	if _, err = db.Exec("UPDATE users SET avatar_key = ? WHERE id = ?", key, userID); err != nil {
+		log.Printf("Error updating avatar: %v", err)
+		if key != "" {
+			deleteAvatarFiles(key)
+		}
+		return err
+	}
+
+	// The old files are no longer referenced, so failing to delete them only wastes space
+	if oldKey != "" {
+		deleteAvatarFiles(oldKey)
+	}
+	return nil
+}
+
+// deleteAvatarFiles removes every size of the avatar stored under key.
+func deleteAvatarFiles(key string) {
+	for _, size := range avatarSizes {
+		blobs.Delete(key + "/" + size.Name + ".png")
+	}
+}
+
+// GenerateIdenticon draws the identicon for seed at the given size. The
+// SHA-256 hash of the seed picks the color and which cells of a 5x5 grid are
+// filled; the grid is mirrored left to right, so the pattern is symmetric.
+func GenerateIdenticon(seed string, size int) image.Image {
+	hash := sha256.Sum256([]byte(seed))
+	fg := hslColor(float64(hash[0])/255*360, 0.45+float64(hash[1])/255*0.2, 0.45+float64(hash[2])/255*0.1)
+	bg := color.RGBA{240, 240, 240, 255}
+
+	// Fill the cells of the left three columns, and mirror them to the right
+	var filled [5][5]bool
+	bit := 0
+	for col := 0; col < 3; col++ {
+		for row := 0; row < 5; row++ {
+			on := hash[3+bit/8]&(1<<(bit%8)) != 0
+			filled[row][col] = on
+			filled[row][4-col] = on
+			bit++
+		}
+	}
+
+	// Center the grid with a margin of half a cell on each side
+	cell := size * 2 / 11
+	offset := (size - cell*5) / 2
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := bg
+			col, row := (x-offset)/cell, (y-offset)/cell
+			if x >= offset && y >= offset && col < 5 && row < 5 && filled[row][col] {
+				c = fg
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// hslColor converts a hue (in degrees), saturation and lightness to an opaque RGB color.
+func hslColor(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 255}
+}
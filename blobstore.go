@@ -0,0 +1,150 @@
+// blobstore.go
+//
+// This file defines where uploaded files such as avatars and attachments are
+// kept. Code that stores files only talks to the BlobStore interface, so the
+// storage backend can be swapped without touching it. The local
+// implementation writes to a directory on disk and serves it under /media/;
+// s3store.go implements an S3 compatible bucket.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore stores files under slash separated keys such as "avatars/12/large.png".
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing file.
+	Put(key string, r io.Reader, contentType string) error
+	// Delete removes the file stored under key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// URL returns the address browsers can load the file from.
+	URL(key string) string
+}
+
+var blobs BlobStore = newBlobStore() // Where uploaded files are kept
+
+// newBlobStore picks the blob store from the environment: an S3 compatible
+// bucket when S3_BUCKET is set, configured by the other S3_* variables, or
+// the local uploads directory otherwise.
+func newBlobStore() BlobStore {
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		return NewS3BlobStore(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_REGION"), bucket,
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), os.Getenv("S3_PUBLIC_URL"))
+	}
+	return NewLocalBlobStore("uploads", "/media/")
+}
+
+// errInvalidKey is returned for keys that could escape the store's directory.
+var errInvalidKey = errors.New("invalid blob key")
+
+// LocalBlobStore keeps files in a directory on the local filesystem. It also
+// serves them, so it can be mounted directly as the handler for its base URL.
+type LocalBlobStore struct {
+	root    string // Directory the files are written to
+	baseURL string // URL prefix the files are served under, ending in "/"
+}
+
+// NewLocalBlobStore creates a store writing to root and served under baseURL.
+func NewLocalBlobStore(root, baseURL string) *LocalBlobStore {
+	return &LocalBlobStore{root: root, baseURL: baseURL}
+}
+
+// path maps a key to a file inside the store's directory.
+func (s *LocalBlobStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned != "/"+key || strings.Contains(key, `\`) {
+		return "", errInvalidKey
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
+
+// Put writes the file to a temporary name first and renames it into place,
+// so readers never see a partially written file.
+func (s *LocalBlobStore) Put(key string, r io.Reader, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		log.Printf("Error creating blob directory: %v", err)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		log.Printf("Error creating blob file: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		log.Printf("Error writing blob: %v", err)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		log.Printf("Error writing blob: %v", err)
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		log.Printf("Error setting blob permissions: %v", err)
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		log.Printf("Error storing blob: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Delete removes a file from the store's directory.
+func (s *LocalBlobStore) Delete(key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting blob: %v", err)
+		return err
+	}
+	return nil
+}
+
+// URL returns the key under the store's base URL.
+func (s *LocalBlobStore) URL(key string) string {
+	return s.baseURL + key
+}
+
+// ServeHTTP serves a stored file. Request paths are expected to have the base
+// URL stripped. Directories are never listed. Stored files are never changed
+// in place (new uploads get new keys), so browsers may cache them for good.
+func (s *LocalBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, err := s.path(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
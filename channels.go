@@ -0,0 +1,216 @@
+// channels.go
+//
+// This file handles creating and editing channels. Each channel has a unique
+// name, a unique URL slug used by /channels/{slug}, an optional description,
+// icon and category, and the user who created it as its owner. When a channel is renamed to
+// a new slug the old one is kept in channel_slug_redirects so existing links
+// keep working.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Channel field limits
+const (
+	maxChannelNameLength        = 50
+	maxChannelSlugLength        = 50
+	maxChannelDescriptionLength = 280
+	maxChannelIconLength        = 8 // Enough for a single emoji, including modifiers
+)
+
+// slugPattern matches lowercase words separated by single dashes.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugSeparators matches runs of characters that are not allowed in slugs.
+var slugSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify derives a URL slug from a channel name, e.g. "Go & Rust!" becomes "go-rust".
+func Slugify(name string) string {
+	slug := slugSeparators.ReplaceAllString(strings.ToLower(name), "-")
+	slug = strings.Trim(slug, "-")
+	if len(slug) > maxChannelSlugLength {
+		slug = strings.TrimRight(slug[:maxChannelSlugLength], "-")
+	}
+	return slug
+}
+
+// ValidateChannelFields checks the user supplied channel fields and returns a
+// message describing the first problem found, or "" if they are valid.
+// Uniqueness is checked separately with IsChannelNameTaken and IsChannelSlugTaken.
+func ValidateChannelFields(name, slug, description, icon string) string {
+	if strings.TrimSpace(name) == "" {
+		return "Channel name is required"
+	}
+	if utf8.RuneCountInString(name) > maxChannelNameLength {
+		return "Channel name must be at most 50 characters"
+	}
+	if slug == "" {
+		return "Channel URL is required"
+	}
+	if len(slug) > maxChannelSlugLength || !slugPattern.MatchString(slug) {
+		return "Channel URL may only contain lowercase letters, numbers and single dashes"
+	}
+	// All-digit slugs would be mistaken for channel IDs in /channels/{id} links
+	if _, err := strconv.Atoi(slug); err == nil {
+		return "Channel URL must contain at least one letter"
+	}
+	if utf8.RuneCountInString(description) > maxChannelDescriptionLength {
+		return "Description must be at most 280 characters"
+	}
+	if utf8.RuneCountInString(icon) > maxChannelIconLength {
+		return "Icon must be a single emoji"
+	}
+	return ""
+}
+
+// IsChannelNameTaken checks if another channel already uses name (case-insensitively).
+// excludeID is the channel being edited, or 0 when creating a channel.
+func IsChannelNameTaken(name string, excludeID int) bool {
+	var id int
+	err := db.QueryRow("SELECT id FROM channels WHERE name = ? AND id <> ?", name, excludeID).Scan(&id)
+	return err == nil
+}
+
+// IsChannelSlugTaken checks if slug is used by another channel, either as its
+// current slug or as an old slug that still redirects to it.
+// excludeID is the channel being edited, or 0 when creating a channel.
+func IsChannelSlugTaken(slug string, excludeID int) bool {
+	var exists bool
+	err := db.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM channels WHERE slug = ? AND id <> ?)
+            OR EXISTS(SELECT 1 FROM channel_slug_redirects WHERE slug = ? AND channel_id <> ?)
+    `, slug, excludeID, slug, excludeID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking channel slug: %v", err)
+		return true
+	}
+	return exists
+}
+
+// CreateChannel creates a channel owned by ownerID and makes the owner a member
+// and follower of it. It returns the new channel's ID.
+func CreateChannel(name, slug, description, icon, category, visibility string, ownerID int) (int, error) {
+	res, err := db.Exec("INSERT INTO channels (name, slug, description, icon, category, visibility, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?)", name, slug, description, icon, category, visibility, ownerID)
+	if err != nil {
+		log.Printf("Error creating channel: %v", err)
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		return 0, err
+	}
+
+	if err := AddChannelMember(int(id), ownerID, RoleOwner); err != nil {
+		return 0, err
+	}
+	if err := ToggleFollowChannel(ownerID, int(id), true); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// UpdateChannel renames and re-describes a channel. If the slug changes, the
+// old slug is recorded so that it redirects to the channel from now on. When a
+// public channel is made private or invite-only, its current followers become
+// members so they keep access.
+func UpdateChannel(channelID int, name, slug, description, icon, category, visibility string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldSlug, oldVisibility string
+	err = tx.QueryRow("SELECT slug, visibility FROM channels WHERE id = ? FOR UPDATE", channelID).Scan(&oldSlug, &oldVisibility)
+	if err != nil {
+		log.Printf("Error retrieving channel: %v", err)
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE channels SET name = ?, slug = ?, description = ?, icon = ?, category = ?, visibility = ? WHERE id = ?", name, slug, description, icon, category, visibility, channelID)
+	if err != nil {
+		log.Printf("Error updating channel: %v", err)
+		return err
+	}
+
+	if oldVisibility == VisibilityPublic && visibility != VisibilityPublic {
+		_, err = tx.Exec("INSERT IGNORE INTO channel_members (channel_id, user_id) SELECT channel_id, user_id FROM user_follows WHERE channel_id = ?", channelID)
+		if err != nil {
+			log.Printf("Error adding followers as members: %v", err)
+			return err
+		}
+	}
+
+	if oldSlug != slug {
+		// The new slug is live again if the channel is renamed back to it
+		_, err = tx.Exec("DELETE FROM channel_slug_redirects WHERE slug = ? AND channel_id = ?", slug, channelID)
+		if err != nil {
+			log.Printf("Error updating channel redirects: %v", err)
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO channel_slug_redirects (slug, channel_id) VALUES (?, ?)", oldSlug, channelID)
+		if err != nil {
+			log.Printf("Error updating channel redirects: %v", err)
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing channel update: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchChannel retrieves a channel by its ID.
+// It returns sql.ErrNoRows if the channel does not exist.
+func FetchChannel(channelID int) (Channel, error) {
+	var channel Channel
+	var ownerID sql.NullInt64
+	err := db.QueryRow(`
+        SELECT id, name, slug, description, icon, category, owner_id, visibility, posting_policy, slow_mode_seconds
+        FROM channels
+        WHERE id = ?
+    `, channelID).Scan(&channel.ID, &channel.Name, &channel.Slug, &channel.Description, &channel.Icon, &channel.Category, &ownerID, &channel.Visibility, &channel.PostingPolicy, &channel.SlowMode)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving channel: %v", err)
+		}
+		return channel, err
+	}
+	channel.OwnerID = int(ownerID.Int64)
+	return channel, nil
+}
+
+// ResolveChannelSlug finds the channel for a slug. It returns the channel ID and
+// whether slug is an old slug that should be redirected to the current one.
+// It returns sql.ErrNoRows if no channel uses or used the slug.
+func ResolveChannelSlug(slug string) (int, bool, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM channels WHERE slug = ?", slug).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	} else if err != sql.ErrNoRows {
+		log.Printf("Error resolving channel slug: %v", err)
+		return 0, false, err
+	}
+
+	err = db.QueryRow("SELECT channel_id FROM channel_slug_redirects WHERE slug = ?", slug).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error resolving channel slug: %v", err)
+		}
+		return 0, false, err
+	}
+	return id, true, nil
+}
@@ -2,12 +2,15 @@
 //
 // This file handles the database connection setup and initialization.
 // It uses MySQL as the database and ensures that the connection is established
-// before any database operations are performed.
+// before any database operations are performed. The connection is opened by
+// main rather than on package initialization, so tests can put a stand-in
+// database in its place.
 
 package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 
 	_ "github.com/go-sql-driver/mysql" // MySQL driver import
@@ -15,9 +18,9 @@ import (
 
 var db *sql.DB // Global variable to hold the database connection
 
-// init initializes the database connection when the program starts.
+// connectDB initializes the database connection when the program starts.
 // It connects to the MySQL database using the provided DSN (Data Source Name).
-func init() {
+func connectDB() {
 	var err error
 	dsn := "tiktok_user:password@tcp(127.0.0.1:3306)/tiktok_app" // Database connection string
 
@@ -33,14 +36,21 @@ func init() {
 	}
 }
 
+// startRedisSubscriber relays Redis messages to the WebSocket hub. Every
+// message says who may receive it: everyone, one user, or the readers of a channel.
 func startRedisSubscriber() {
-	pubsub := redisClient.Subscribe(ctx, newJotsChannel)
+	pubsub := redisClient.Subscribe(ctx, newJotsChannel, notificationsChannel, eventsChannel)
 	defer pubsub.Close()
 
 	ch := pubsub.Channel()
 
 	for msg := range ch {
 		log.Printf("New message received from Redis: %s", msg.Payload)
-		broadcast <- msg.Payload
+		var message hubMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+			log.Printf("Error decoding hub message: %v", err)
+			continue
+		}
+		outbound <- message
 	}
 }
@@ -0,0 +1,210 @@
+// discovery.go
+//
+// This file handles finding channels: listing them with search, category
+// filters and sorting for the channels page, and recommending channels from
+// co-follow statistics, i.e. "people who follow channels you follow also
+// follow these". Only channels the user may see are ever listed: invite-only
+// channels appear for their members alone.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// ChannelCategory is a topic a channel can be filed under.
+type ChannelCategory struct {
+	Key  string // Stored in channels.category
+	Name string // Shown in the UI
+}
+
+// channelCategories lists the categories channels can choose from, in display order.
+var channelCategories = []ChannelCategory{
+	{"news", "News"},
+	{"tech", "Technology"},
+	{"science", "Science"},
+	{"gaming", "Gaming"},
+	{"sports", "Sports"},
+	{"music", "Music"},
+	{"art", "Art & Design"},
+	{"community", "Community"},
+	{"other", "Other"},
+}
+
+// IsValidCategory reports whether key is one of channelCategories, or empty for no category.
+func IsValidCategory(key string) bool {
+	if key == "" {
+		return true
+	}
+	for _, category := range channelCategories {
+		if category.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// CategoryName returns the display name of a category key.
+func CategoryName(key string) string {
+	for _, category := range channelCategories {
+		if category.Key == key {
+			return category.Name
+		}
+	}
+	return key
+}
+
+// Channel list sort orders
+const (
+	SortByName      = "name"
+	SortByFollowers = "followers"
+	SortByActivity  = "activity" // Jots posted in the last 7 days
+)
+
+// channelSorts maps each sort order to its ORDER BY clause.
+var channelSorts = map[string]string{
+	SortByName:      "c.name",
+	SortByFollowers: "c.follower_count DESC, c.name",
+	SortByActivity:  "recent_jots DESC, c.name",
+}
+
+// ChannelQuery filters and orders a channel listing. The zero value lists
+// every visible channel by name.
+type ChannelQuery struct {
+	Search     string // Matched against the name and description
+	Category   string // Only channels in this category when set
+	Sort       string // One of the SortBy* constants; SortByName when empty
+	IDs        []int  // Only these channels when set
+	FollowedBy int    // Only channels this user follows when set
+}
+
+// SearchChannels lists the channels userID can see that match the query.
+// Every channel's follower count and the user's follow, membership and join
+// request state are loaded in the same query, so listing costs one query no
+// matter how many channels there are.
+func SearchChannels(userID int, query ChannelQuery) ([]Channel, error) {
+	where := []string{"1 = 1"}
+	args := []any{userID, userID, userID}
+	if query.Search != "" {
+		pattern := "%" + escapeLike(query.Search) + "%"
+		where = append(where, "(c.name LIKE ? OR c.description LIKE ?)")
+		args = append(args, pattern, pattern)
+	}
+	if query.Category != "" {
+		where = append(where, "c.category = ?")
+		args = append(args, query.Category)
+	}
+	if len(query.IDs) > 0 {
+		placeholders, idArgs := inClause(query.IDs)
+		where = append(where, "c.id IN ("+placeholders+")")
+		args = append(args, idArgs...)
+	}
+	if query.FollowedBy != 0 {
+		where = append(where, "c.id IN (SELECT channel_id FROM user_follows WHERE user_id = ?)")
+		args = append(args, query.FollowedBy)
+	}
+	orderBy, ok := channelSorts[query.Sort]
+	if !ok {
+		orderBy = channelSorts[SortByName]
+	}
+
+	rows, err := db.Query(`
+        SELECT c.id, c.name, c.slug, c.description, c.icon, c.category, COALESCE(c.owner_id, 0), c.visibility,
+               c.posting_policy, c.slow_mode_seconds,
+               c.follower_count,
+               EXISTS(SELECT 1 FROM user_follows uf WHERE uf.channel_id = c.id AND uf.user_id = ?) AS is_following,
+               COALESCE((SELECT m.role FROM channel_members m WHERE m.channel_id = c.id AND m.user_id = ?), '') AS member_role,
+               EXISTS(SELECT 1 FROM channel_join_requests jr WHERE jr.channel_id = c.id AND jr.user_id = ?) AS has_requested,
+               (SELECT COUNT(*) FROM content WHERE content.channel_id = c.id AND content.created_at > NOW() - INTERVAL 7 DAY) AS recent_jots
+        FROM channels c
+        WHERE `+strings.Join(where, " AND ")+`
+        HAVING c.visibility <> 'invite' OR member_role <> ''
+        ORDER BY `+orderBy, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []Channel
+	for rows.Next() {
+		var channel Channel
+		err := rows.Scan(&channel.ID, &channel.Name, &channel.Slug, &channel.Description, &channel.Icon, &channel.Category, &channel.OwnerID, &channel.Visibility, &channel.PostingPolicy, &channel.SlowMode, &channel.FollowerCount, &channel.IsFollowing, &channel.Role, &channel.HasRequested, &channel.RecentJots)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		channel.IsMember = channel.Role != ""
+		channels = append(channels, channel)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied search term.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// RecommendChannels suggests up to limit channels for a user from co-follow
+// statistics: a channel scores one point for every follow it shares with the
+// user's own follows, i.e. for each pair of (channel the user follows, other
+// follower of it) where that follower also follows the candidate. Channels
+// the user already follows, is banned from or cannot see are left out.
+func RecommendChannels(userID, limit int) ([]Channel, error) {
+	rows, err := db.Query(`
+        SELECT theirs.channel_id, COUNT(*) AS score
+        FROM user_follows AS mine
+        JOIN user_follows AS others ON others.channel_id = mine.channel_id AND others.user_id <> mine.user_id
+        JOIN user_follows AS theirs ON theirs.user_id = others.user_id
+        JOIN channels AS c ON c.id = theirs.channel_id
+        WHERE mine.user_id = ?
+          AND c.visibility <> 'invite'
+          AND NOT EXISTS (SELECT 1 FROM user_follows f WHERE f.user_id = mine.user_id AND f.channel_id = theirs.channel_id)
+          AND NOT EXISTS (SELECT 1 FROM channel_bans b WHERE b.user_id = mine.user_id AND b.channel_id = theirs.channel_id)
+        GROUP BY theirs.channel_id
+        ORDER BY score DESC, theirs.channel_id
+        LIMIT ?
+    `, userID, limit)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	scores := make(map[int]int)
+	for rows.Next() {
+		var id, score int
+		if err := rows.Scan(&id, &score); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+		scores[id] = score
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Load the channels' details and keep the recommendation order
+	channels, err := SearchChannels(userID, ChannelQuery{IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(channels, func(i, j int) bool {
+		return scores[channels[i].ID] > scores[channels[j].ID]
+	})
+	return channels, nil
+}
@@ -0,0 +1,85 @@
+// discovery_test.go
+//
+// This file checks that listing channels costs a fixed number of queries,
+// however many channels there are.
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// channelListingDB answers the channel listing queries with n channels, the
+// first few of which are also recommended.
+func channelListingDB(n int) stubResponder {
+	columns := []string{"id", "name", "slug", "description", "icon", "category", "owner_id", "visibility",
+		"posting_policy", "slow_mode_seconds", "follower_count", "is_following", "member_role", "has_requested", "recent_jots"}
+	channels := make([][]driver.Value, n)
+	for i := range channels {
+		id := int64(i + 1)
+		channels[i] = []driver.Value{id, fmt.Sprintf("channel-%d", id), fmt.Sprintf("channel-%d", id), "", "", "",
+			int64(1), VisibilityPublic, PostingOpen, int64(0), id, id%2 == 0, "", false, int64(0)}
+	}
+	return func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, "FROM user_follows AS mine"):
+			var recommended [][]driver.Value
+			for i := 0; i < n && i < recommendedCount; i++ {
+				recommended = append(recommended, []driver.Value{int64(i + 1), int64(n - i)})
+			}
+			return []string{"channel_id", "score"}, recommended
+		case strings.Contains(query, "FROM channels c"):
+			if strings.Contains(query, "c.id IN (") {
+				return columns, channels[:min(n, recommendedCount)]
+			}
+			return columns, channels
+		}
+		return nil, nil
+	}
+}
+
+// listChannels renders the channels page for user 1.
+func listChannels(tb testing.TB) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/channels", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: "1"})
+	rec := httptest.NewRecorder()
+	ChannelsHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		tb.Fatalf("GET /channels returned %d: %s", rec.Code, rec.Body)
+	}
+	return rec
+}
+
+func TestChannelListingQueryCount(t *testing.T) {
+	counts := make(map[int]int64)
+	for _, n := range []int{1, 10, 1000} {
+		queries := useStubDB(t, channelListingDB(n))
+		rec := listChannels(t)
+		if name := fmt.Sprintf("channel-%d<", n); !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("listing %d channels: page does not show the last channel", n)
+		}
+		counts[n] = atomic.LoadInt64(queries)
+	}
+	if counts[1] != counts[1000] || counts[10] != counts[1000] {
+		t.Errorf("queries per listing grow with the number of channels: %v", counts)
+	}
+}
+
+func BenchmarkChannelListing(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("channels=%d", n), func(b *testing.B) {
+			queries := useStubDB(b, channelListingDB(n))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				listChannels(b)
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(queries))/float64(b.N), "queries/op")
+		})
+	}
+}
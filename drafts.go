@@ -0,0 +1,159 @@
+// drafts.go
+//
+// This file handles drafts: jots that are still being written. Each user has
+// at most one draft per target channel (plus one for jots outside any
+// channel), which the composer saves automatically as the user types, so
+// switching devices or closing the tab loses nothing. Drafts are deleted
+// once they are posted or scheduled. They are stored on the server and
+// exposed as JSON under /api/drafts, so the web composer, the CLI and other
+// clients all share them.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// maxDraftBytes is the largest draft that can be saved. Drafts may run over
+// the jot length limit while they are edited, so this only guards storage.
+const maxDraftBytes = 60000
+
+// Draft is an unfinished jot.
+type Draft struct {
+	ID          int       `json:"id"`
+	ChannelID   *int      `json:"channel_id"` // Channel the jot is meant for, nil for none
+	ChannelName string    `json:"channel_name,omitempty"`
+	Text        string    `json:"text"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SaveDraft stores the user's draft for a channel (nil for none), replacing
+// the previous one. Saving empty text deletes the draft instead, and returns
+// a nil draft. A *ValidationError is returned for drafts that are too large
+// or aimed at a channel that does not exist.
+func SaveDraft(userID int, channelID *int, text string) (*Draft, error) {
+	if len(text) > maxDraftBytes {
+		return nil, &ValidationError{Fields: map[string]string{"text": "The draft is too long to save"}}
+	}
+	if NormalizeText(text) == "" {
+		err := DeleteDraft(userID, channelID)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	if channelID != nil {
+		if _, err := FetchChannel(*channelID); err == sql.ErrNoRows {
+			return nil, &ValidationError{Fields: map[string]string{"channel_id": "This channel no longer exists"}}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := db.Exec(`
+        INSERT INTO drafts (user_id, channel_id, text) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE text = VALUES(text), updated_at = CURRENT_TIMESTAMP
+    `, userID, channelID, text)
+	if err != nil {
+		log.Printf("Error saving draft: %v", err)
+		return nil, err
+	}
+
+	draft, err := scanDraft(db.QueryRow(draftSelect+"WHERE d.user_id = ? AND d.channel_key = ?", userID, channelKey(channelID)))
+	if err != nil {
+		log.Printf("Error fetching saved draft: %v", err)
+		return nil, err
+	}
+	return &draft, nil
+}
+
+// channelKey returns the value of drafts.channel_key for a channel. The
+// column stands in for channel_id in the table's unique key, where NULLs
+// would never collide.
+func channelKey(channelID *int) int {
+	if channelID == nil {
+		return 0
+	}
+	return *channelID
+}
+
+// draftSelect is the column list scanned by scanDraft.
+const draftSelect = `
+        SELECT d.id, d.channel_id, COALESCE(c.name, ''), d.text, DATE_FORMAT(d.updated_at, '%Y-%m-%d %H:%i:%s')
+        FROM drafts d
+        LEFT JOIN channels c ON c.id = d.channel_id
+`
+
+// scanDraft scans a row selected with draftSelect.
+func scanDraft(rs rowScanner) (Draft, error) {
+	var draft Draft
+	var channelID sql.NullInt64
+	var updatedAt string
+	if err := rs.Scan(&draft.ID, &channelID, &draft.ChannelName, &draft.Text, &updatedAt); err != nil {
+		return draft, err
+	}
+	if channelID.Valid {
+		id := int(channelID.Int64)
+		draft.ChannelID = &id
+	}
+	draft.UpdatedAt, _ = time.Parse("2006-01-02 15:04:05", updatedAt)
+	return draft, nil
+}
+
+// FetchDrafts returns a user's drafts, most recently edited first.
+func FetchDrafts(userID int) ([]Draft, error) {
+	rows, err := db.Query(draftSelect+"WHERE d.user_id = ? ORDER BY d.updated_at DESC, d.id DESC", userID)
+	if err != nil {
+		log.Printf("Error fetching drafts: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []Draft
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			log.Printf("Error scanning draft: %v", err)
+			return nil, err
+		}
+		drafts = append(drafts, draft)
+	}
+	return drafts, rows.Err()
+}
+
+// FetchDraft returns one of a user's drafts.
+// It returns sql.ErrNoRows if the user has no draft with that ID.
+func FetchDraft(id, userID int) (*Draft, error) {
+	draft, err := scanDraft(db.QueryRow(draftSelect+"WHERE d.id = ? AND d.user_id = ?", id, userID))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error fetching draft: %v", err)
+		}
+		return nil, err
+	}
+	return &draft, nil
+}
+
+// DeleteDraft deletes the user's draft for a channel (nil for none), as
+// when it has been posted. It returns sql.ErrNoRows if there was none.
+func DeleteDraft(userID int, channelID *int) error {
+	res, err := db.Exec("DELETE FROM drafts WHERE user_id = ? AND channel_key = ?", userID, channelKey(channelID))
+	if err != nil {
+		log.Printf("Error deleting draft: %v", err)
+		return err
+	}
+	return requireAffected(res)
+}
+
+// DeleteDraftByID deletes one of a user's drafts.
+// It returns sql.ErrNoRows if the user has no draft with that ID.
+func DeleteDraftByID(id, userID int) error {
+	res, err := db.Exec("DELETE FROM drafts WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		log.Printf("Error deleting draft: %v", err)
+		return err
+	}
+	return requireAffected(res)
+}
@@ -0,0 +1,116 @@
+// ephemeral.go
+//
+// This file handles ephemeral jots, which disappear after a lifetime picked
+// in the composer, e.g. for standups or on-call chatter. The expiry time is
+// stored in content.expires_at (UTC). Expired jots stop showing up at once,
+// since jotSelect filters them out; a background reaper on every server
+// instance then deletes them for good, with their replies and attachments,
+// and tells open pages to remove them.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	expiredJotInterval = time.Minute // How often the reaper looks for expired jots
+	expiredJotBatch    = 100         // Most jots deleted per check
+)
+
+// JotLifetime is one of the lifetimes offered for ephemeral jots.
+type JotLifetime struct {
+	Value    string // Form value
+	Label    string
+	Duration time.Duration
+}
+
+// jotLifetimes are the lifetimes the composer offers, shortest first.
+var jotLifetimes = []JotLifetime{
+	{"1h", "1 hour", time.Hour},
+	{"24h", "1 day", 24 * time.Hour},
+	{"168h", "1 week", 7 * 24 * time.Hour},
+}
+
+// ParseJotLifetime returns the lifetime for a form value, zero for a
+// permanent jot when value is empty. ok is false for unknown values.
+func ParseJotLifetime(value string) (lifetime time.Duration, ok bool) {
+	if value == "" {
+		return 0, true
+	}
+	for _, l := range jotLifetimes {
+		if l.Value == value {
+			return l.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// ExpiresIn returns how long an ephemeral jot has left, e.g. "3h 20m".
+func (j Jot) ExpiresIn() string {
+	if j.ExpiresAt == nil {
+		return ""
+	}
+	seconds := int(time.Until(*j.ExpiresAt).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return formatWait(seconds)
+}
+
+// startExpiredJotReaper starts deleting expired jots in the background.
+func startExpiredJotReaper() {
+	go func() {
+		ticker := time.NewTicker(expiredJotInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reapExpiredJots()
+		}
+	}()
+}
+
+// reapExpiredJots deletes the jots whose lifetime has passed.
+func reapExpiredJots() {
+	rows, err := db.Query("SELECT id, channel_id FROM content WHERE expires_at <= UTC_TIMESTAMP() ORDER BY expires_at LIMIT ?", expiredJotBatch)
+	if err != nil {
+		log.Printf("Error fetching expired jots: %v", err)
+		return
+	}
+	expired := map[int]int{} // Jot ID -> channel ID, 0 if none
+	for rows.Next() {
+		var id int
+		var channelID sql.NullInt64
+		if err := rows.Scan(&id, &channelID); err != nil {
+			log.Printf("Error scanning expired jot: %v", err)
+			break
+		}
+		expired[id] = int(channelID.Int64)
+	}
+	rows.Close()
+
+	for id, channelID := range expired {
+		deleteExpiredJot(id, channelID)
+	}
+}
+
+// deleteExpiredJot deletes an expired jot and its files, and removes it from
+// open pages. Another instance may have deleted it first; only the instance
+// whose DELETE removed the row publishes the event.
+func deleteExpiredJot(jotID, channelID int) {
+	attachments, err := fetchAttachments([]int{jotID})
+	if err != nil {
+		return
+	}
+	res, err := db.Exec("DELETE FROM content WHERE id = ? AND expires_at <= UTC_TIMESTAMP()", jotID)
+	if err != nil {
+		log.Printf("Error deleting expired jot: %v", err)
+		return
+	}
+	if requireAffected(res) != nil {
+		return
+	}
+	DeleteAttachmentFiles(attachments[jotID])
+	PublishEvent(Event{Type: EventJotExpired, JotID: jotID, ChannelID: channelID})
+}
@@ -0,0 +1,109 @@
+// events.go
+//
+// This file defines the structured real-time events pushed to browsers over
+// the WebSocket hub. Events are JSON objects with a "type" field so the client
+// can tell them apart from the plain-text notifications sent on the other
+// Redis channels. They are published through Redis so every server instance
+// relays them to its own clients.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Define the Redis channel for structured jot events
+const eventsChannel = "jot_events_channel"
+
+// Event types understood by static/ws.js
+const (
+	EventReactionsUpdated = "reactions.updated"
+	EventJotRemoved       = "jot.removed"
+	EventPinsUpdated      = "pins.updated"
+	EventLinkPreviewReady = "preview.ready"
+	EventJotExpired       = "jot.expired"
+	EventPollUpdated      = "poll.updated"
+)
+
+// Event is the JSON envelope sent to WebSocket clients.
+type Event struct {
+	Type      string `json:"type"`           // One of the Event* constants
+	JotID     int    `json:"jot_id"`         // Jot the event refers to
+	Data      any    `json:"data,omitempty"` // Event specific payload
+	ChannelID int    `json:"-"`              // Channel of the jot, 0 if none; limits who receives the event
+
+	// Set to the jot's ID to also limit the event to the users who voted in
+	// its poll, or to those who did not
+	PollVoters    int `json:"-"`
+	PollNonVoters int `json:"-"`
+}
+
+// hubMessage is the payload published on every Redis channel relayed to the
+// WebSocket hub. It carries the text sent to clients along with its audience.
+type hubMessage struct {
+	UserID    int    `json:"user_id,omitempty"`    // Deliver only to this user when set
+	ChannelID int    `json:"channel_id,omitempty"` // Deliver only to users who can read this channel when set
+	Message   string `json:"message"`              // Text or JSON event sent to the clients
+
+	PollVoters    int `json:"poll_voters,omitempty"`     // Deliver only to users who voted in this jot's poll when set
+	PollNonVoters int `json:"poll_non_voters,omitempty"` // Deliver only to users who did not vote in this jot's poll when set
+}
+
+// PublishEvent publishes an event to Redis for delivery to the WebSocket
+// clients allowed to see the event's channel and, for poll events, its
+// results.
+func PublishEvent(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return err
+	}
+	return publishHubMessage(eventsChannel, hubMessage{ChannelID: event.ChannelID, PollVoters: event.PollVoters, PollNonVoters: event.PollNonVoters, Message: string(payload)})
+}
+
+// publishHubMessage publishes a message for the WebSocket hub on a Redis channel.
+func publishHubMessage(redisChannel string, message hubMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error encoding hub message: %v", err)
+		return err
+	}
+
+	err = redisClient.Publish(ctx, redisChannel, payload).Err()
+	if err != nil {
+		log.Printf("Error publishing to Redis: %v", err)
+		return err
+	}
+	return nil
+}
+
+// messageAudience returns a function reporting which users may receive a hub
+// message, combining every limit set on it.
+func messageAudience(message hubMessage) (func(userID int) bool, error) {
+	if message.UserID != 0 {
+		// Addressed to a single user
+		return func(userID int) bool { return userID == message.UserID }, nil
+	}
+
+	include := func(int) bool { return true }
+	if message.ChannelID != 0 {
+		// Only readers of the channel may see it
+		canRead, err := channelAudience(message.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		include = canRead
+	}
+
+	// Poll results only go to the users allowed to see them
+	if jotID := max(message.PollVoters, message.PollNonVoters); jotID != 0 {
+		voters, err := fetchPollVoterIDs(jotID)
+		if err != nil {
+			return nil, err
+		}
+		wantVoters, inChannel := message.PollVoters != 0, include
+		include = func(userID int) bool { return voters[userID] == wantVoters && inChannel(userID) }
+	}
+	return include, nil
+}
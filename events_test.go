@@ -0,0 +1,50 @@
+// events_test.go
+//
+// This file tests who real-time messages are delivered to.
+
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestPollResultsAudience(t *testing.T) {
+	// Users 1 and 2 voted in the poll of jot 7, in a public channel that
+	// bans user 4
+	useStubDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, "FROM channels"):
+			return []string{"visibility"}, [][]driver.Value{{VisibilityPublic}}
+		case strings.Contains(query, "FROM channel_bans"):
+			return []string{"user_id"}, [][]driver.Value{{int64(4)}}
+		case strings.Contains(query, "FROM poll_voters"):
+			return []string{"user_id"}, [][]driver.Value{{int64(1)}, {int64(2)}}
+		}
+		return []string{"user_id", "role"}, nil
+	})
+
+	tests := []struct {
+		name    string
+		message hubMessage
+		want    map[int]bool // User ID -> whether they receive the message
+	}{
+		{"tally", hubMessage{ChannelID: 3, PollVoters: 7}, map[int]bool{1: true, 2: true, 3: false, 4: false}},
+		{"voter count", hubMessage{ChannelID: 3, PollNonVoters: 7}, map[int]bool{1: false, 2: false, 3: true, 4: false}},
+		{"tally outside channels", hubMessage{PollVoters: 7}, map[int]bool{1: true, 3: false, 4: false}},
+		{"channel", hubMessage{ChannelID: 3}, map[int]bool{1: true, 3: true, 4: false}},
+		{"one user", hubMessage{UserID: 3, PollVoters: 7}, map[int]bool{1: false, 3: true}},
+	}
+	for _, tt := range tests {
+		include, err := messageAudience(tt.message)
+		if err != nil {
+			t.Fatalf("%s: returned %v", tt.name, err)
+		}
+		for userID, want := range tt.want {
+			if got := include(userID); got != want {
+				t.Errorf("%s: user %d included = %v, want %v", tt.name, userID, got, want)
+			}
+		}
+	}
+}
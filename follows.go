@@ -0,0 +1,148 @@
+// follows.go
+//
+// This file handles user-to-user follows, stored in user_followers next to
+// the channel follows in user_follows. Following a user notifies them, adds
+// them to the follower's following list and puts their jots in the
+// follower's home feed.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// FollowEntry is a user listed on a followers or following page.
+type FollowEntry struct {
+	Username  string
+	AvatarKey string    // See User.AvatarKey
+	Since     time.Time // When the follow started
+}
+
+// FollowUser makes followerID follow followedID and notifies the followed
+// user. Following an already followed user is a no-op, and users can't
+// follow themselves.
+func FollowUser(followerID, followedID int) error {
+	if followerID == followedID {
+		return nil
+	}
+
+	res, err := db.Exec("INSERT IGNORE INTO user_followers (follower_id, followed_id) VALUES (?, ?)", followerID, followedID)
+	if err != nil {
+		log.Printf("Error following user: %v", err)
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+
+	username, err := GetUsernameByID(followerID)
+	if err != nil {
+		return err
+	}
+	return CreateNotification(followedID, followerID, "follow", 0, username+" started following you")
+}
+
+// UnfollowUser removes followerID's follow of followedID.
+func UnfollowUser(followerID, followedID int) error {
+	_, err := db.Exec("DELETE FROM user_followers WHERE follower_id = ? AND followed_id = ?", followerID, followedID)
+	if err != nil {
+		log.Printf("Error unfollowing user: %v", err)
+	}
+	return err
+}
+
+// IsFollowingUser checks if followerID follows followedID.
+func IsFollowingUser(followerID, followedID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_followers WHERE follower_id = ? AND followed_id = ?)", followerID, followedID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking user follow: %v", err)
+	}
+	return exists, err
+}
+
+// FetchFollowCounts returns how many users follow userID and how many users userID follows.
+func FetchFollowCounts(userID int) (followers, following int, err error) {
+	err = db.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM user_followers WHERE followed_id = ?),
+               (SELECT COUNT(*) FROM user_followers WHERE follower_id = ?)
+    `, userID, userID).Scan(&followers, &following)
+	if err != nil {
+		log.Printf("Error counting follows: %v", err)
+	}
+	return followers, following, err
+}
+
+// FetchFollowers retrieves the users following userID, most recent first.
+func FetchFollowers(userID int) ([]FollowEntry, error) {
+	return fetchFollowEntries(`
+        SELECT users.username, users.avatar_key, DATE_FORMAT(user_followers.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM user_followers
+        JOIN users ON users.id = user_followers.follower_id
+        WHERE user_followers.followed_id = ?
+        ORDER BY user_followers.created_at DESC
+    `, userID)
+}
+
+// FetchFollowing retrieves the users userID follows, most recent first.
+func FetchFollowing(userID int) ([]FollowEntry, error) {
+	return fetchFollowEntries(`
+        SELECT users.username, users.avatar_key, DATE_FORMAT(user_followers.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM user_followers
+        JOIN users ON users.id = user_followers.followed_id
+        WHERE user_followers.follower_id = ?
+        ORDER BY user_followers.created_at DESC
+    `, userID)
+}
+
+// fetchFollowEntries runs a query selecting a username, avatar key and timestamp.
+func fetchFollowEntries(query string, args ...any) ([]FollowEntry, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []FollowEntry
+	for rows.Next() {
+		var entry FollowEntry
+		var sinceStr string
+		if err := rows.Scan(&entry.Username, &entry.AvatarKey, &sinceStr); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		entry.Since, err = time.Parse("2006-01-02 15:04:05", sinceStr)
+		if err != nil {
+			log.Printf("Time parse error: %v", err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// FetchFollowingFeed retrieves the jots for the Following tab of the home
+// page: the user's own top-level jots and those from the channels and users
+// they follow, newest first.
+func FetchFollowingFeed(userID int) ([]Jot, error) {
+	rows, err := db.Query(jotSelect+`
+        WHERE content.parent_id IS NULL AND `+visibleJotsClause+`
+          AND (content.user_id = ?
+               OR content.channel_id IN (SELECT channel_id FROM user_follows WHERE user_id = ?)
+               OR content.user_id IN (SELECT followed_id FROM user_followers WHERE follower_id = ?))
+        ORDER BY content.created_at DESC
+    `, userID, userID, userID, userID, userID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanJots(rows)
+}
@@ -0,0 +1,29 @@
+// format.go
+//
+// This file holds the helper functions available to templates, including the
+// one that turns stored jot text into the HTML shown on the page.
+
+package main
+
+import (
+	"html/template"
+)
+
+// templateFuncs are the helper functions available to every template.
+var templateFuncs = template.FuncMap{
+	"formatJot": FormatJot,
+	"slowMode":  formatWait,
+	"category":  CategoryName,
+	"avatar":    AvatarURL,
+}
+
+// FormatJot returns the HTML of a jot's text: the rendering cached when it was
+// saved, or a fresh rendering of its Markdown with its resolved mentions (see
+// markdown.go). The text is always escaped by the renderer, so user input can
+// never inject markup of its own, and the result is marked safe for templates.
+func FormatJot(jot Jot) template.HTML {
+	if jot.Rendered != "" {
+		return template.HTML(jot.Rendered)
+	}
+	return template.HTML(RenderMarkdown(jot.Text, jot.Mentions))
+}
@@ -7,19 +7,33 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv" // Import the strconv package
-	"text/template"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket" // Import the WebSocket package
 )
 
+// Page sizes for paginated listings
+const (
+	jotsPerPage       = 20 // Jots shown per page on paginated timelines
+	trendingPanelSize = 10 // Tags shown in the trending panel
+	recommendedCount  = 5  // Channels suggested on the channels page
+)
+
 // Precompile templates to avoid repeated parsing during each request
-var templates = template.Must(template.ParseGlob("templates/*.html"))
+var templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html"))
 
-// HomeHandler displays all jots on the home page.
+// HomeHandler displays all jots on the home page, or with ?feed=following
+// only those from the user and the channels and users they follow.
 // It checks if the user is authenticated before rendering the page.
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// Redirect to login page if the user is not authenticated
@@ -28,18 +42,43 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch all jots from the database
-	jots, err := FetchAllJots()
+	// Fetch all jots the user may read, or just the ones they follow
+	userID := GetAuthenticatedUserID(r)
+	following := r.URL.Query().Get("feed") == "following"
+	var jots []Jot
+	var err error
+	if following {
+		jots, err = FetchFollowingFeed(userID)
+	} else {
+		jots, err = FetchAllJots(userID)
+	}
 	if err != nil {
 		http.Error(w, "Unable to fetch jots", http.StatusInternalServerError)
 		return
 	}
 
+	// Load shared originals and reaction counts for every jot on the page
+	if err := AttachJotDetails(jots, userID); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the trending tags panel
+	trending, err := FetchTrendingTags(trendingPanelSize)
+	if err != nil {
+		http.Error(w, "Unable to fetch trending tags", http.StatusInternalServerError)
+		return
+	}
+
 	// Data structure to pass to the template
 	data := struct {
-		Jots []Jot
+		Jots      []Jot
+		Following bool // Showing the Following tab
+		Trending  []TrendingTag
 	}{
-		Jots: jots,
+		Jots:      jots,
+		Following: following,
+		Trending:  trending,
 	}
 
 	// Render the home template with the fetched jots
@@ -60,7 +99,12 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Handle content submission
 	if r.Method == "POST" {
-		r.ParseForm()
+		// Leave room for the other fields next to the largest accepted attachments
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachments*maxAttachmentBytes+1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Attachments must be at most 10 MB each", http.StatusRequestEntityTooLarge)
+			return
+		}
 		content := r.FormValue("content")
 		channelIDStr := r.FormValue("channelID")
 		var channelID *int
@@ -71,32 +115,363 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		userID := GetAuthenticatedUserID(r)
-		err := SaveContentToDB(content, userID, channelID)
+		lifetime, ok := ParseJotLifetime(r.FormValue("expires_in"))
+		if !ok {
+			renderDashboard(w, r, "", map[string]string{"expires_in": "Pick one of the listed durations"})
+			return
+		}
+
+		// A poll is attached when any of its options is filled in
+		var poll *PollInput
+		pollOptions := make([]string, maxPollOptions)
+		for i := range pollOptions {
+			pollOptions[i] = r.FormValue(fmt.Sprintf("poll_option%d", i))
+		}
+		if strings.TrimSpace(strings.Join(pollOptions, "")) != "" {
+			duration, ok := ParsePollDuration(r.FormValue("poll_duration"))
+			if !ok {
+				renderDashboard(w, r, "", map[string]string{"poll": "Pick how long the poll stays open"})
+				return
+			}
+			poll = &PollInput{Options: pollOptions, Multiple: r.FormValue("poll_multiple") != "", Duration: duration}
+		}
+
+		// Process and store the attached files before the jot is saved
+		var uploads []AttachmentUpload
+		for i := 0; i < maxAttachments; i++ {
+			file, header, err := r.FormFile(fmt.Sprintf("attachment%d", i))
+			if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+				continue
+			} else if err != nil {
+				http.Error(w, "Unable to read attachments", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			uploads = append(uploads, AttachmentUpload{Filename: header.Filename, AltText: r.FormValue(fmt.Sprintf("alt%d", i)), File: file})
+		}
+
+		// Jots with a publish time are stored for the scheduled jot worker instead
+		if publishAt := r.FormValue("publish_at"); publishAt != "" {
+			if len(uploads) > 0 {
+				renderDashboard(w, r, "", map[string]string{"attachments": "Scheduled jots can't have attachments"})
+				return
+			}
+			if lifetime > 0 {
+				renderDashboard(w, r, "", map[string]string{"expires_in": "Scheduled jots can't disappear"})
+				return
+			}
+			if poll != nil {
+				renderDashboard(w, r, "", map[string]string{"poll": "Scheduled jots can't have polls"})
+				return
+			}
+			err := ScheduleJot(userID, content, channelID, publishAt, r.FormValue("timezone"))
+			if validationErr, ok := err.(*ValidationError); ok {
+				renderDashboard(w, r, "", validationErr.Fields)
+				return
+			} else if err != nil {
+				http.Error(w, "Unable to schedule jot", http.StatusInternalServerError)
+				return
+			}
+			DeleteDraft(userID, channelID)
+			http.Redirect(w, r, "/scheduled", http.StatusSeeOther)
+			return
+		}
+
+		attachments, err := PrepareAttachments(userID, uploads)
+		if uploadErr, ok := err.(*UploadError); ok {
+			renderDashboard(w, r, "", map[string]string{"attachments": uploadErr.Message})
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to save attachments", http.StatusInternalServerError)
+			return
+		}
+
+		// The channel's posting policy is enforced when the jot is saved. An
+		// error means nothing was saved, so the stored files are not needed
+		err = SaveContentToDB(content, userID, channelID, nil, attachments, lifetime, poll)
 		if err != nil {
+			DeleteAttachmentFiles(attachments)
+		}
+		if validationErr, ok := err.(*ValidationError); ok {
+			// Show the composer again with the problems next to the fields
+			renderDashboard(w, r, "", validationErr.Fields)
+			return
+		} else if postingErr, ok := err.(*PostingError); ok {
+			// Show the composer again with the reason and the user's text
+			renderDashboard(w, r, postingErr.Message, nil)
+			return
+		} else if uploadErr, ok := err.(*UploadError); ok {
+			// Other uploads filled the quota since the attachments were checked
+			renderDashboard(w, r, "", map[string]string{"attachments": uploadErr.Message})
+			return
+		} else if err != nil {
 			http.Error(w, "Unable to save content", http.StatusInternalServerError)
 			return
 		}
+		// The draft the jot was written in is done with
+		DeleteDraft(userID, channelID)
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 		return
 	}
 
-	// Fetch available channels for the dropdown
+	renderDashboard(w, r, "", nil)
+}
+
+// renderDashboard renders the composer. After a rejected POST the submitted
+// text, channel, lifetime, poll and publish time are shown again, with
+// errorMessage above the form and fieldErrors next to the form fields they
+// name. A "draft" query parameter resumes one of the user's drafts.
+func renderDashboard(w http.ResponseWriter, r *http.Request, errorMessage string, fieldErrors map[string]string) {
 	userID := GetAuthenticatedUserID(r)
+
+	// Fetch available channels for the dropdown
 	channels, err := FetchAllChannels(userID)
 	if err != nil {
 		http.Error(w, "Unable to fetch channels", http.StatusInternalServerError)
 		return
 	}
+	drafts, err := FetchDrafts(userID)
+	if err != nil {
+		http.Error(w, "Unable to fetch drafts", http.StatusInternalServerError)
+		return
+	}
 
 	// Render the dashboard template with the channels
 	data := struct {
-		Channels []Channel
+		Channels        []Channel
+		Drafts          []Draft
+		Error           string
+		FieldErrors     map[string]string // Form field name -> problem with its value
+		Content         string
+		ChannelID       int
+		PublishAt       string // datetime-local value of a jot being scheduled
+		ExpiresIn       string // Lifetime picked for an ephemeral jot, empty for none
+		Lifetimes       []JotLifetime
+		PollOptions     []string // One text field per option a poll can have
+		PollMultiple    bool
+		PollDuration    string
+		PollDurations   []PollDuration
+		AttachmentSlots []int // One file and alt text field per attachment a jot can have
 	}{
-		Channels: channels,
+		Channels:        channels,
+		Drafts:          drafts,
+		Error:           errorMessage,
+		FieldErrors:     fieldErrors,
+		Content:         r.FormValue("content"),
+		PublishAt:       r.FormValue("publish_at"),
+		ExpiresIn:       r.FormValue("expires_in"),
+		Lifetimes:       jotLifetimes,
+		PollOptions:     make([]string, maxPollOptions),
+		PollMultiple:    r.FormValue("poll_multiple") != "",
+		PollDuration:    r.FormValue("poll_duration"),
+		PollDurations:   pollDurations,
+		AttachmentSlots: make([]int, maxAttachments),
+	}
+	data.ChannelID, _ = strconv.Atoi(r.FormValue("channelID"))
+	for i := range data.PollOptions {
+		data.PollOptions[i] = r.FormValue(fmt.Sprintf("poll_option%d", i))
+	}
+	if data.PollDuration == "" {
+		data.PollDuration = defaultPollDuration
+	}
+	if draftID, err := strconv.Atoi(r.FormValue("draft")); err == nil && data.Content == "" {
+		draft, err := FetchDraft(draftID, userID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Unable to fetch draft", http.StatusInternalServerError)
+			return
+		}
+		if draft != nil {
+			data.Content, data.ChannelID = draft.Text, channelKey(draft.ChannelID)
+		}
 	}
 	templates.ExecuteTemplate(w, "dashboard.html", data)
 }
 
+// DraftsAPIHandler serves the logged in user's drafts as JSON, for the
+// composer's autosave and for other clients such as the CLI:
+//
+//	GET    /api/drafts       list the drafts, most recently edited first
+//	PUT    /api/drafts       save {"channel_id": 3, "text": "..."} as the draft for
+//	                         that channel (null for none); empty text deletes it
+//	GET    /api/drafts/{id}  fetch one draft
+//	DELETE /api/drafts/{id}  delete one draft
+//
+// Invalid drafts are answered with 400 and {"errors": {field: message}}.
+func DraftsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Not logged in"})
+		return
+	}
+	userID := GetAuthenticatedUserID(r)
+
+	// Requests for a single draft
+	if idStr := strings.TrimPrefix(r.URL.Path, "/api/drafts/"); idStr != r.URL.Path && idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "No such draft"})
+			return
+		}
+		switch r.Method {
+		case "GET":
+			draft, err := FetchDraft(id, userID)
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "No such draft"})
+			} else if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Unable to fetch draft"})
+			} else {
+				writeJSON(w, http.StatusOK, draft)
+			}
+		case "DELETE":
+			err := DeleteDraftByID(id, userID)
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "No such draft"})
+			} else if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Unable to delete draft"})
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		drafts, err := FetchDrafts(userID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Unable to fetch drafts"})
+			return
+		}
+		if drafts == nil {
+			drafts = []Draft{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]Draft{"drafts": drafts})
+	case "PUT", "POST":
+		var input struct {
+			ChannelID *int   `json:"channel_id"`
+			Text      string `json:"text"`
+		}
+		body := http.MaxBytesReader(w, r.Body, maxDraftBytes+4096)
+		if err := json.NewDecoder(body).Decode(&input); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Expected a JSON object with channel_id and text"})
+			return
+		}
+		if input.ChannelID != nil && *input.ChannelID == 0 {
+			input.ChannelID = nil
+		}
+		draft, err := SaveDraft(userID, input.ChannelID, input.Text)
+		if validationErr, ok := err.(*ValidationError); ok {
+			writeJSON(w, http.StatusBadRequest, map[string]map[string]string{"errors": validationErr.Fields})
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Unable to save draft"})
+		} else if draft == nil {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			writeJSON(w, http.StatusOK, draft)
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// writeJSON sends value as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
+
+// ScheduledHandler lists the logged in user's scheduled jots, and edits or
+// cancels one of them on POST.
+func ScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	userID := GetAuthenticatedUserID(r)
+
+	var formError string
+	var failedID int // Jot whose edit was rejected; its form keeps the submitted values
+	if r.Method == "POST" {
+		r.ParseForm()
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid scheduled jot ID", http.StatusBadRequest)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "update":
+			err = UpdateScheduledJot(id, userID, r.FormValue("content"), r.FormValue("publish_at"), r.FormValue("timezone"))
+		case "cancel":
+			err = CancelScheduledJot(id, userID)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		if validationErr, ok := err.(*ValidationError); ok {
+			formError, failedID = validationErr.Error(), id
+		} else if err == sql.ErrNoRows {
+			formError = "That jot has already been published or cancelled"
+		} else if err != nil {
+			http.Error(w, "Unable to update scheduled jot", http.StatusInternalServerError)
+			return
+		} else {
+			http.Redirect(w, r, "/scheduled", http.StatusSeeOther)
+			return
+		}
+	}
+
+	scheduled, err := FetchScheduledJots(userID)
+	if err != nil {
+		http.Error(w, "Unable to fetch scheduled jots", http.StatusInternalServerError)
+		return
+	}
+	for i := range scheduled {
+		if scheduled[i].ID == failedID {
+			scheduled[i].Text = r.FormValue("content")
+		}
+	}
+
+	data := struct {
+		Scheduled []ScheduledJot
+		Error     string
+		FailedID  int    // Jot whose edit was rejected
+		PublishAt string // Publish time submitted for that jot
+	}{
+		Scheduled: scheduled,
+		Error:     formError,
+		FailedID:  failedID,
+		PublishAt: r.FormValue("publish_at"),
+	}
+	templates.ExecuteTemplate(w, "scheduled.html", data)
+}
+
+// PreviewHandler renders the text posted by the composer as it would appear
+// in a jot and returns the HTML fragment.
+func PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	rendered, err := PreviewMarkdown(r.FormValue("content"))
+	if err != nil {
+		http.Error(w, "Unable to render preview", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(rendered))
+}
+
 // LoginHandler handles user authentication by checking credentials.
 // It sets a session cookie upon successful login and handles error messages on failure.
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -226,33 +601,53 @@ func GetAuthenticatedUserID(r *http.Request) int {
 	return userID
 }
 
-// ChannelsHandler displays the channels page
+// ChannelsHandler displays the channels page, where channels can be searched,
+// filtered by category and sorted, along with recommended channels.
 func ChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	// Redirect to login page if the user is not authenticated
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	// Get the authenticated user ID
 	userID := GetAuthenticatedUserID(r)
 
-	// Fetch all channels, passing the userID as an argument
-	channels, err := FetchAllChannels(userID)
+	// Read the search, category filter and sort order from the query string
+	query := ChannelQuery{
+		Search:   strings.TrimSpace(r.URL.Query().Get("q")),
+		Category: r.URL.Query().Get("category"),
+		Sort:     r.URL.Query().Get("sort"),
+	}
+	if _, ok := channelSorts[query.Sort]; !ok {
+		query.Sort = SortByName
+	}
+
+	// Fetch the matching channels, passing the userID as an argument
+	channels, err := SearchChannels(userID, query)
 	if err != nil {
 		http.Error(w, "Unable to fetch channels", http.StatusInternalServerError)
 		return
 	}
 
-	// For each channel, check if the user is following it
-	for i := range channels {
-		isFollowing, err := IsUserFollowingChannel(userID, channels[i].ID)
-		if err != nil {
-			http.Error(w, "Error checking following status", http.StatusInternalServerError)
-			return
-		}
-		channels[i].IsFollowing = isFollowing
+	// Suggest channels followed by people who follow the same channels as the user
+	recommended, err := RecommendChannels(userID, recommendedCount)
+	if err != nil {
+		http.Error(w, "Unable to fetch recommended channels", http.StatusInternalServerError)
+		return
 	}
 
 	// Prepare data to pass to the template
 	data := struct {
-		Channels []Channel
+		Channels    []Channel
+		Recommended []Channel
+		Query       ChannelQuery
+		Categories  []ChannelCategory
 	}{
-		Channels: channels,
+		Channels:    channels,
+		Recommended: recommended,
+		Query:       query,
+		Categories:  channelCategories,
 	}
 
 	// Render the template with the channel data
@@ -278,6 +673,22 @@ func FollowChannelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Following a private channel requires membership
+	if follow {
+		canView, err := Authorize(userID, channelID, ActionReadChannel)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+			return
+		}
+		if !canView {
+			http.Error(w, "You are not a member of this channel", http.StatusForbidden)
+			return
+		}
+	}
+
 	err = ToggleFollowChannel(userID, channelID, follow)
 	if err != nil {
 		http.Error(w, "Unable to update follow status", http.StatusInternalServerError)
@@ -287,37 +698,100 @@ func FollowChannelHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/channels", http.StatusSeeOther)
 }
 
-// ChannelJotsHandler displays jots for a specific channel
+// ChannelJotsHandler displays jots for a specific channel.
+// Channels are addressed by slug; numeric IDs and old slugs redirect to the current slug.
 func ChannelJotsHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the channel ID from the URL path
-	channelIDStr := r.URL.Path[len("/channels/"):]
-	channelID, err := strconv.Atoi(channelIDStr)
-	if err != nil {
-		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+	// Redirect to login page if the user is not authenticated
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// Fetch jots for the specific channel
-	jots, err := FetchJotsByChannel(channelID)
+	// Get the channel slug (or legacy numeric ID) from the URL path
+	slug := r.URL.Path[len("/channels/"):]
+	channelID, err := strconv.Atoi(slug)
+	redirect := err == nil
 	if err != nil {
-		http.Error(w, "Unable to fetch jots for this channel", http.StatusInternalServerError)
-		return
+		channelID, redirect, err = ResolveChannelSlug(slug)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to fetch channel details", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// Fetch the channel name for display
-	channelName, err := GetChannelNameByID(channelID)
-	if err != nil {
+	// Fetch the channel for display, along with the user's access to it
+	userID := GetAuthenticatedUserID(r)
+	channel, err := FetchChannelForUser(channelID, userID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		http.Error(w, "Unable to fetch channel details", http.StatusInternalServerError)
 		return
 	}
 
+	// Invite-only channels don't reveal that they exist to non-members
+	if channel.Visibility == VisibilityInviteOnly && !channel.CanRead() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Send old links to the channel's current URL
+	if redirect {
+		http.Redirect(w, r, "/channels/"+channel.Slug, http.StatusMovedPermanently)
+		return
+	}
+
+	// Fetch pinned and chronological jots for the specific channel; non-members of a private channel only see the join option
+	var jots, pinned []Jot
+	if channel.CanRead() {
+		jots, err = FetchJotsByChannel(channelID)
+		if err != nil {
+			http.Error(w, "Unable to fetch jots for this channel", http.StatusInternalServerError)
+			return
+		}
+		pinned, err = FetchPinnedJots(channelID)
+		if err != nil {
+			http.Error(w, "Unable to fetch pinned jots", http.StatusInternalServerError)
+			return
+		}
+
+		// Mark pinned jots in the chronological list so moderators see unpin instead of pin
+		isPinned := make(map[int]bool, len(pinned))
+		for _, jot := range pinned {
+			isPinned[jot.ID] = true
+		}
+		for i := range jots {
+			jots[i].IsPinned = isPinned[jots[i].ID]
+		}
+
+		// Load shared originals and reaction counts, marking the viewer's own reactions
+		if err := AttachJotDetails(jots, userID); err != nil {
+			http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+			return
+		}
+		if err := AttachJotDetails(pinned, userID); err != nil {
+			http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Prepare data to pass to the template
 	data := struct {
-		ChannelName string
-		Jots        []Jot
+		Channel   Channel
+		IsOwner   bool
+		Pinned    []Jot
+		MaxPinned int
+		Jots      []Jot
 	}{
-		ChannelName: channelName,
-		Jots:        jots,
+		Channel:   channel,
+		IsOwner:   userID == channel.OwnerID,
+		Pinned:    pinned,
+		MaxPinned: maxPinnedJots,
+		Jots:      jots,
 	}
 
 	// Render the template with the channel jots
@@ -327,71 +801,1291 @@ func ChannelJotsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// WebSocket clients map to keep track of all connected clients
-var clients = make(map[*websocket.Conn]bool)
-var broadcast = make(chan string)
+// channelForm holds the values and error message shown on the channel create/edit form.
+type channelForm struct {
+	Title       string // Page title, e.g. "Create Channel"
+	Action      string // URL the form posts to
+	ChannelID   int    // 0 when creating a channel
+	Name        string
+	Slug        string
+	Description string
+	Icon        string
+	Category    string
+	Categories  []ChannelCategory // Choices for the category select
+	Visibility  string
+	Error       string
+}
 
-func broadcastMessage(message string) {
-	for client := range clients {
-		err := client.WriteMessage(websocket.TextMessage, []byte(message))
-		if err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			client.Close()
-			delete(clients, client)
-		}
+// readChannelForm reads the submitted channel fields, deriving the slug from the
+// name when none was given, and validates them. excludeID is the channel being
+// edited, or 0 when creating one.
+func readChannelForm(r *http.Request, form *channelForm, excludeID int) {
+	r.ParseForm()
+	form.Name = strings.TrimSpace(r.FormValue("name"))
+	form.Slug = strings.ToLower(strings.TrimSpace(r.FormValue("slug")))
+	form.Description = strings.TrimSpace(r.FormValue("description"))
+	form.Icon = strings.TrimSpace(r.FormValue("icon"))
+	form.Category = r.FormValue("category")
+	form.Visibility = r.FormValue("visibility")
+	if form.Slug == "" {
+		form.Slug = Slugify(form.Name)
+	}
+
+	form.Error = ValidateChannelFields(form.Name, form.Slug, form.Description, form.Icon)
+	if form.Error == "" && !IsValidCategory(form.Category) {
+		form.Error = "Please choose a category from the list"
+	}
+	if form.Error == "" && !IsValidVisibility(form.Visibility) {
+		form.Error = "Please choose who can see the channel"
+	}
+	if form.Error == "" && IsChannelNameTaken(form.Name, excludeID) {
+		form.Error = "A channel with this name already exists"
+	}
+	if form.Error == "" && IsChannelSlugTaken(form.Slug, excludeID) {
+		form.Error = "This channel URL is already taken"
 	}
 }
 
-func listenForRedisMessages() {
-	pubsub := redisClient.Subscribe(ctx, newJotsChannel)
-	defer pubsub.Close()
+// CreateChannelHandler shows the channel creation form and creates channels.
+// The user who creates a channel becomes its owner.
+func CreateChannelHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
-	ch := pubsub.Channel()
-	for msg := range ch {
-		broadcastMessage(msg.Payload)
+	form := channelForm{Title: "Create Channel", Action: "/channels/new", Categories: channelCategories, Visibility: VisibilityPublic}
+	if r.Method == "POST" {
+		readChannelForm(r, &form, 0)
+		if form.Error == "" {
+			_, err := CreateChannel(form.Name, form.Slug, form.Description, form.Icon, form.Category, form.Visibility, GetAuthenticatedUserID(r))
+			if err != nil {
+				http.Error(w, "Unable to create channel", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/channels/"+form.Slug, http.StatusSeeOther)
+			return
+		}
 	}
-}
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	// Render the form, with the submitted values and error after a failed POST
+	templates.ExecuteTemplate(w, "channel_form.html", form)
 }
 
-// WebSocketHandler handles WebSocket requests from the client
-func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade to websocket: %v", err)
+// EditChannelHandler lets a channel's owner rename it and change its description, icon and visibility.
+func EditChannelHandler(w http.ResponseWriter, r *http.Request) {
+	channel, ok := requireChannelPermission(w, r, ActionEditChannel)
+	if !ok {
 		return
 	}
-	defer conn.Close()
-
-	// Add this connection to a list of active clients
-	clients[conn] = true
 
-	for {
-		// Keep the connection open
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			delete(clients, conn)
-			break
+	form := channelForm{
+		Title:       "Edit Channel",
+		Action:      "/edit-channel",
+		ChannelID:   channel.ID,
+		Name:        channel.Name,
+		Slug:        channel.Slug,
+		Description: channel.Description,
+		Icon:        channel.Icon,
+		Category:    channel.Category,
+		Categories:  channelCategories,
+		Visibility:  channel.Visibility,
+	}
+	if r.Method == "POST" {
+		readChannelForm(r, &form, channel.ID)
+		if form.Error == "" {
+			err := UpdateChannel(channel.ID, form.Name, form.Slug, form.Description, form.Icon, form.Category, form.Visibility)
+			if err != nil {
+				http.Error(w, "Unable to update channel", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/channels/"+form.Slug, http.StatusSeeOther)
+			return
 		}
 	}
+
+	// Render the form, with the submitted values and error after a failed POST
+	templates.ExecuteTemplate(w, "channel_form.html", form)
 }
 
-// handleMessages listens for incoming broadcast messages and sends them to all WebSocket clients
-func handleMessages() {
-	for {
-		message := <-broadcast
-		for client := range clients {
-			err := client.WriteMessage(websocket.TextMessage, []byte(message))
-			if err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
+// ReactHandler adds or removes a reaction on a jot.
+// The form sends the desired state ("add" or "remove") rather than a toggle so
+// that repeating a request never flips the reaction back.
+func ReactHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	r.ParseForm()
+	emoji := r.FormValue("emoji")
+	add := r.FormValue("action") == "add"
+
+	// Convert jotID from string to int
+	jotID, err := strconv.Atoi(r.FormValue("jotID"))
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+	if !IsValidReaction(emoji) {
+		http.Error(w, "Invalid reaction", http.StatusBadRequest)
+		return
+	}
+	if !requireJotAccess(w, r, userID, jotID) {
+		return
+	}
+
+	err = SetReaction(jotID, userID, emoji, add)
+	if err != nil {
+		http.Error(w, "Unable to update reaction", http.StatusInternalServerError)
+		return
+	}
+
+	// Send the user back to the page they reacted from
+	redirectBack(w, r, "/")
+}
+
+// VoteHandler records the logged in user's vote on a jot's poll. Multiple
+// choice polls send one "option" value per picked option.
+func VoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	r.ParseForm()
+	jotID, err := strconv.Atoi(r.FormValue("jotID"))
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+	var optionIDs []int
+	for _, value := range r.Form["option"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid option", http.StatusBadRequest)
+			return
+		}
+		optionIDs = append(optionIDs, id)
+	}
+	if !requireJotAccess(w, r, userID, jotID) {
+		return
+	}
+
+	err = Vote(jotID, userID, optionIDs)
+	if pollErr, ok := err.(*PollError); ok {
+		http.Error(w, pollErr.Message, http.StatusBadRequest)
+		return
+	} else if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to record vote", http.StatusInternalServerError)
+		return
+	}
+
+	// Send the user back to the page they voted from, now showing the results
+	redirectBack(w, r, "/")
+}
+
+// ShareHandler shows the share form for a jot and saves re-jots and quotes.
+// Leaving the commentary empty makes a plain re-jot; otherwise the jot is quoted.
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	r.ParseForm()
+	jotID, err := strconv.Atoi(r.FormValue("jotID"))
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+	if !requireJotAccess(w, r, userID, jotID) {
+		return
+	}
+
+	// Handle share submission
+	if r.Method == "POST" {
+		content := r.FormValue("content")
+		var channelID *int
+		if id, err := strconv.Atoi(r.FormValue("channelID")); err == nil && id != 0 {
+			channelID = &id
+		}
+
+		// Jots from private and invite-only channels may only be shared within the same channel
+		if public, err := CanViewJot(0, jotID); err != nil {
+			http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+			return
+		} else if !public {
+			source, err := jotChannelID(jotID)
+			if err != nil {
+				http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+				return
+			}
+			if channelID == nil || *channelID != source {
+				http.Error(w, "Jots from private channels can only be shared within the channel", http.StatusForbidden)
+				return
+			}
+		}
+		err := SaveContentToDB(content, userID, channelID, &jotID, nil, 0, nil)
+		if validationErr, ok := err.(*ValidationError); ok {
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+			return
+		} else if postingErr, ok := err.(*PostingError); ok {
+			http.Error(w, postingErr.Message, http.StatusForbidden)
+			return
+		} else if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to share jot", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// Fetch the jot being shared so it can be previewed above the form
+	jot, err := FetchJotByID(jotID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch available channels for the dropdown
+	channels, err := FetchAllChannels(userID)
+	if err != nil {
+		http.Error(w, "Unable to fetch channels", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Jot      Jot
+		Channels []Channel
+	}{
+		Jot:      jot,
+		Channels: channels,
+	}
+
+	err = templates.ExecuteTemplate(w, "share.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// TagHandler lists the jots tagged with a hashtag, one page at a time.
+func TagHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Get the tag from the URL path
+	// Only names that can appear as hashtags have a page
+	tag := strings.ToLower(r.URL.Path[len("/tags/"):])
+	if !IsValidTag(tag) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Pages are numbered from 1
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	jots, hasMore, err := FetchJotsByTag(tag, userID, jotsPerPage, (page-1)*jotsPerPage)
+	if err != nil {
+		http.Error(w, "Unable to fetch jots for this tag", http.StatusInternalServerError)
+		return
+	}
+	if err := AttachJotDetails(jots, userID); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+
+	trending, err := FetchTrendingTags(trendingPanelSize)
+	if err != nil {
+		http.Error(w, "Unable to fetch trending tags", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Tag      string
+		Jots     []Jot
+		Trending []TrendingTag
+		Page     int
+		PrevPage int // 0 when there is no previous page
+		NextPage int // 0 when there is no next page
+	}{
+		Tag:      tag,
+		Jots:     jots,
+		Trending: trending,
+		Page:     page,
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if hasMore {
+		data.NextPage = page + 1
+	}
+
+	err = templates.ExecuteTemplate(w, "tag.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// ProfileHandler shows a user's profile at /u/{username}: their display name,
+// bio, avatar, join date, follower counts, followed channels and a paginated
+// list of their jots. The users they follow and are followed by are listed at
+// /u/{username}/following and /u/{username}/followers.
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Get the username and optional list from the URL path
+	username, list, _ := strings.Cut(r.URL.Path[len("/u/"):], "/")
+	profile, err := FetchUserProfile(username)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch user", http.StatusInternalServerError)
+		return
+	}
+	profileID := profile.ID
+
+	switch list {
+	case "":
+	case "followers", "following":
+		renderFollowList(w, username, profileID, list)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Pages are numbered from 1
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	jots, hasMore, err := FetchJotsByUser(username, userID, jotsPerPage, (page-1)*jotsPerPage)
+	if err != nil {
+		http.Error(w, "Unable to fetch jots for this user", http.StatusInternalServerError)
+		return
+	}
+	if err := AttachJotDetails(jots, userID); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+
+	followers, following, err := FetchFollowCounts(profileID)
+	if err != nil {
+		http.Error(w, "Unable to fetch follow counts", http.StatusInternalServerError)
+		return
+	}
+	isFollowing, err := IsFollowingUser(userID, profileID)
+	if err != nil {
+		http.Error(w, "Unable to fetch follow status", http.StatusInternalServerError)
+		return
+	}
+
+	// Only channels the viewer can see are listed
+	channels, err := SearchChannels(userID, ChannelQuery{FollowedBy: profileID})
+	if err != nil {
+		http.Error(w, "Unable to fetch followed channels", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Username    string
+		Profile     User
+		Channels    []Channel // Channels the user follows
+		IsSelf      bool      // Whether the logged in user is viewing their own profile
+		IsFollowing bool
+		Followers   int
+		Following   int
+		Jots        []Jot
+		Page        int
+		PrevPage    int // 0 when there is no previous page
+		NextPage    int // 0 when there is no next page
+	}{
+		Username:    username,
+		Profile:     profile,
+		Channels:    channels,
+		IsSelf:      userID == profileID,
+		IsFollowing: isFollowing,
+		Followers:   followers,
+		Following:   following,
+		Jots:        jots,
+		Page:        page,
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if hasMore {
+		data.NextPage = page + 1
+	}
+
+	err = templates.ExecuteTemplate(w, "profile.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// SettingsHandler shows and saves the logged in user's profile settings.
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	profile, err := FetchUserProfileByID(GetAuthenticatedUserID(r))
+	if err != nil {
+		http.Error(w, "Unable to fetch profile", http.StatusInternalServerError)
+		return
+	}
+
+	var formError string
+	if r.Method == "POST" {
+		// Leave room for the other fields next to the largest accepted avatar
+		r.Body = http.MaxBytesReader(w, r.Body, maxAvatarBytes+1<<20)
+		if err := r.ParseMultipartForm(maxAvatarBytes + 1<<20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Avatars must be at most 5 MB", http.StatusRequestEntityTooLarge)
+			return
+		}
+		profile.DisplayName = strings.TrimSpace(r.FormValue("displayName"))
+		profile.Bio = strings.TrimSpace(r.FormValue("bio"))
+
+		formError = ValidateProfileFields(profile.DisplayName, profile.Bio)
+		if formError == "" {
+			formError, err = saveAvatarField(r, profile.ID)
+			if err != nil {
+				http.Error(w, "Unable to save avatar", http.StatusInternalServerError)
+				return
+			}
+		}
+		if formError == "" {
+			if err := UpdateProfile(profile.ID, profile.DisplayName, profile.Bio); err != nil {
+				http.Error(w, "Unable to save profile", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/u/"+url.PathEscape(profile.Username), http.StatusSeeOther)
+			return
+		}
+	}
+
+	// Render the form, with the submitted values and error after a failed POST
+	data := struct {
+		Profile User
+		Error   string
+	}{
+		Profile: profile,
+		Error:   formError,
+	}
+	err = templates.ExecuteTemplate(w, "settings.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// saveAvatarField applies the avatar part of the settings form: a new upload
+// or the "remove avatar" checkbox. It returns a message for the user if the
+// upload was rejected.
+func saveAvatarField(r *http.Request, userID int) (string, error) {
+	if r.FormValue("removeAvatar") == "on" {
+		return "", RemoveAvatar(userID)
+	}
+
+	file, _, err := r.FormFile("avatar")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	err = SaveAvatar(userID, file)
+	if uploadErr, ok := err.(*UploadError); ok {
+		return uploadErr.Message, nil
+	}
+	return "", err
+}
+
+// IdenticonHandler serves generated avatars at /identicons/{size}/{username}.png.
+// Identicons only depend on the username, so browsers may cache them for good.
+func IdenticonHandler(w http.ResponseWriter, r *http.Request) {
+	size, name, _ := strings.Cut(r.URL.Path[len("/identicons/"):], "/")
+	username, ok := strings.CutSuffix(name, ".png")
+	pixels := avatarSizePixels(size)
+	if !ok || username == "" || pixels == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	encoded, err := encodePNG(GenerateIdenticon(username, pixels))
+	if err != nil {
+		http.Error(w, "Unable to generate avatar", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(encoded)
+}
+
+// renderFollowList renders the followers or following list of a user.
+func renderFollowList(w http.ResponseWriter, username string, userID int, list string) {
+	var entries []FollowEntry
+	var err error
+	if list == "followers" {
+		entries, err = FetchFollowers(userID)
+	} else {
+		entries, err = FetchFollowing(userID)
+	}
+	if err != nil {
+		http.Error(w, "Unable to fetch follows", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Username string
+		List     string // "followers" or "following"
+		Entries  []FollowEntry
+	}{
+		Username: username,
+		List:     list,
+		Entries:  entries,
+	}
+	err = templates.ExecuteTemplate(w, "follow_list.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// FollowUserHandler handles following and unfollowing another user.
+func FollowUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	username := r.FormValue("username")
+	followedID, err := GetUserIDByUsername(username)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	switch r.FormValue("action") {
+	case "follow":
+		err = FollowUser(userID, followedID)
+	case "unfollow":
+		err = UnfollowUser(userID, followedID)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to update follow", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, "/u/"+url.PathEscape(username))
+}
+
+// RemoveJotHandler lets a channel's owner and moderators remove a jot posted in the channel.
+func RemoveJotHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	jotID, err := strconv.Atoi(r.FormValue("jotID"))
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+
+	// Only jots in a channel can be moderated
+	userID := GetAuthenticatedUserID(r)
+	channelID, err := jotChannelID(jotID)
+	if err == sql.ErrNoRows || (err == nil && channelID == 0) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := Authorize(userID, channelID, ActionRemoveJot)
+	if err != nil {
+		http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Only the channel's moderators can remove jots", http.StatusForbidden)
+		return
+	}
+
+	if err := RemoveJot(jotID, userID); err != nil {
+		http.Error(w, "Unable to remove jot", http.StatusInternalServerError)
+		return
+	}
+	redirectBack(w, r, "/channels")
+}
+
+// PinHandler lets a channel's owner and moderators pin, unpin and reorder
+// top-level jots of the channel.
+func PinHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	jotID, err := strconv.Atoi(r.FormValue("jotID"))
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+
+	// Only top-level jots in a channel can be pinned
+	jot, err := FetchJotByID(jotID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+		return
+	}
+	channelID, err := jotChannelID(jotID)
+	if err != nil {
+		http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+		return
+	}
+	if channelID == 0 || jot.ParentID != nil {
+		http.Error(w, "Only jots posted in a channel can be pinned", http.StatusBadRequest)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	allowed, err := Authorize(userID, channelID, ActionPinJot)
+	if err != nil {
+		http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Only the channel's moderators can pin jots", http.StatusForbidden)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "pin":
+		var pinned bool
+		pinned, err = PinJot(channelID, jotID, userID)
+		if err == nil && !pinned {
+			http.Error(w, fmt.Sprintf("A channel can have at most %d pinned jots", maxPinnedJots), http.StatusConflict)
+			return
+		}
+	case "unpin":
+		err = UnpinJot(channelID, jotID, userID)
+	case "up":
+		err = MovePin(channelID, jotID, true)
+	case "down":
+		err = MovePin(channelID, jotID, false)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to update pinned jots", http.StatusInternalServerError)
+		return
+	}
+	redirectBack(w, r, "/channels")
+}
+
+// requireJotAccess checks that the user may read a jot. It writes a 404 for
+// missing jots and jots in channels the user cannot read, so private jots
+// can't be probed for, and reports whether the handler may continue.
+func requireJotAccess(w http.ResponseWriter, r *http.Request, userID, jotID int) bool {
+	canView, err := CanViewJot(userID, jotID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+		return false
+	}
+	if !canView {
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+// requireChannelPermission loads the channel named by the channelID form value,
+// with the logged in user's role, and checks that Authorize allows them the
+// action. It writes the error response itself and reports whether the handler
+// may continue.
+func requireChannelPermission(w http.ResponseWriter, r *http.Request, action ChannelAction) (Channel, bool) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return Channel{}, false
+	}
+
+	r.ParseForm()
+	channelID, err := strconv.Atoi(r.FormValue("channelID"))
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return Channel{}, false
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	channel, err := FetchChannelForUser(channelID, userID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return Channel{}, false
+	} else if err != nil {
+		http.Error(w, "Unable to fetch channel details", http.StatusInternalServerError)
+		return Channel{}, false
+	}
+
+	allowed, err := Authorize(userID, channelID, action)
+	if err != nil {
+		http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+		return Channel{}, false
+	}
+	if !allowed {
+		http.Error(w, "You are not allowed to manage this channel", http.StatusForbidden)
+		return Channel{}, false
+	}
+	return channel, true
+}
+
+// JoinChannelHandler handles a user's request to join a private channel.
+// The owner is notified and approves or rejects the request on the members page.
+func JoinChannelHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	r.ParseForm()
+	channelID, err := strconv.Atoi(r.FormValue("channelID"))
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	channel, err := FetchChannel(channelID)
+	if err == sql.ErrNoRows || (err == nil && channel.Visibility == VisibilityInviteOnly) {
+		// Invite-only channels can only be joined through an invite link
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch channel details", http.StatusInternalServerError)
+		return
+	}
+
+	// Banned users can't ask to join again
+	if banned, err := isBanned(userID, channelID); err != nil {
+		http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+		return
+	} else if banned {
+		http.Error(w, "You are banned from this channel", http.StatusForbidden)
+		return
+	}
+
+	if channel.Visibility == VisibilityPrivate {
+		err = RequestToJoinChannel(channelID, userID)
+	}
+	if err != nil {
+		http.Error(w, "Unable to send join request", http.StatusInternalServerError)
+		return
+	}
+
+	redirectBack(w, r, "/channels")
+}
+
+// memberActions maps the actions on the members page to the permission they need.
+var memberActions = map[string]ChannelAction{
+	"approve": ActionReviewMembers,
+	"reject":  ActionReviewMembers,
+	"remove":  ActionReviewMembers,
+	"ban":     ActionBanUser,
+	"unban":   ActionBanUser,
+	"promote": ActionManageRoles,
+	"demote":  ActionManageRoles,
+	"posting": ActionSetPostingPolicy,
+	"invite":  ActionManageInvites,
+	"revoke":  ActionManageInvites,
+}
+
+// ChannelMembersHandler shows a channel's members, pending join requests, bans,
+// posting policy, invite links and audit log to its owner and moderators, and
+// handles their actions on them. Each action is checked with Authorize.
+func ChannelMembersHandler(w http.ResponseWriter, r *http.Request) {
+	channel, ok := requireChannelPermission(w, r, ActionReviewMembers)
+	if !ok {
+		return
+	}
+	actorID := GetAuthenticatedUserID(r)
+
+	// Handle owner and moderator actions
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+		permission, known := memberActions[action]
+		if !known {
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		allowed, err := Authorize(actorID, channel.ID, permission)
+		if err != nil {
+			http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "You are not allowed to do this", http.StatusForbidden)
+			return
+		}
+
+		// Moderators may only act on users below them
+		userID, _ := strconv.Atoi(r.FormValue("userID"))
+		if userID != 0 {
+			target, err := loadChannelAccess(userID, channel.ID)
+			if err != nil {
+				http.Error(w, "Unable to check channel access", http.StatusInternalServerError)
+				return
+			}
+			if !outranks(channel.Role, target.Role) {
+				http.Error(w, "You are not allowed to do this", http.StatusForbidden)
+				return
+			}
+		}
+
+		switch action {
+		case "approve":
+			err = ApproveJoinRequest(channel.ID, actorID, userID)
+		case "reject":
+			err = RejectJoinRequest(channel.ID, userID)
+		case "remove":
+			err = RemoveChannelMember(channel.ID, actorID, userID)
+		case "ban":
+			_, err = BanUser(channel.ID, actorID, userID)
+		case "unban":
+			err = UnbanUser(channel.ID, actorID, userID)
+		case "promote":
+			_, err = SetMemberRole(channel.ID, actorID, userID, RoleModerator)
+		case "demote":
+			_, err = SetMemberRole(channel.ID, actorID, userID, RoleMember)
+		case "posting":
+			policy := r.FormValue("postingPolicy")
+			seconds, _ := strconv.Atoi(r.FormValue("slowModeSeconds"))
+			if !IsValidPostingPolicy(policy) || (policy == PostingSlowMode && (seconds < 1 || seconds > maxSlowModeSeconds)) {
+				http.Error(w, "Slow mode needs an interval between 1 second and 6 hours", http.StatusBadRequest)
+				return
+			}
+			err = SetPostingPolicy(channel.ID, actorID, policy, seconds)
+		case "invite":
+			hours, _ := strconv.Atoi(r.FormValue("expiresInHours"))
+			maxUses, _ := strconv.Atoi(r.FormValue("maxUses"))
+			if hours < 0 || maxUses < 0 {
+				http.Error(w, "Invalid invite settings", http.StatusBadRequest)
+				return
+			}
+			_, err = CreateInvite(channel.ID, actorID, time.Duration(hours)*time.Hour, maxUses)
+		case "revoke":
+			err = RevokeInvite(channel.ID, r.FormValue("token"))
+		}
+		if err == sql.ErrNoRows && action == "approve" {
+			http.Error(w, "This user has no pending join request", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to update channel members", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/channel-members?channelID=%d", channel.ID), http.StatusSeeOther)
+		return
+	}
+
+	members, err := FetchChannelMembers(channel.ID)
+	if err != nil {
+		http.Error(w, "Unable to fetch channel members", http.StatusInternalServerError)
+		return
+	}
+	requests, err := FetchJoinRequests(channel.ID)
+	if err != nil {
+		http.Error(w, "Unable to fetch join requests", http.StatusInternalServerError)
+		return
+	}
+	bans, err := FetchBannedUsers(channel.ID)
+	if err != nil {
+		http.Error(w, "Unable to fetch bans", http.StatusInternalServerError)
+		return
+	}
+	auditLog, err := FetchAuditLog(channel.ID)
+	if err != nil {
+		http.Error(w, "Unable to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	// Invite links are only shown to those who can manage them
+	var invites []ChannelInvite
+	if channel.Role == RoleOwner {
+		invites, err = FetchInvites(channel.ID)
+		if err != nil {
+			http.Error(w, "Unable to fetch invites", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := struct {
+		Channel  Channel
+		Members  []ChannelMember
+		Requests []ChannelMember
+		Bans     []ChannelMember
+		Invites  []ChannelInvite
+		AuditLog []AuditEntry
+		Host     string // Used to show full invite URLs
+	}{
+		Channel:  channel,
+		Members:  members,
+		Requests: requests,
+		Bans:     bans,
+		Invites:  invites,
+		AuditLog: auditLog,
+		Host:     r.Host,
+	}
+
+	err = templates.ExecuteTemplate(w, "channel_members.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// InviteHandler shows an invite link's channel and lets the user join it.
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Get the invite token from the URL path
+	invite, err := FetchInvite(r.URL.Path[len("/invite/"):])
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch invite", http.StatusInternalServerError)
+		return
+	}
+
+	channel, err := FetchChannel(invite.ChannelID)
+	if err != nil {
+		http.Error(w, "Unable to fetch channel details", http.StatusInternalServerError)
+		return
+	}
+
+	// Handle joining through the invite
+	if r.Method == "POST" {
+		joined, err := RedeemInvite(invite, GetAuthenticatedUserID(r))
+		if err != nil {
+			http.Error(w, "Unable to join channel", http.StatusInternalServerError)
+			return
+		}
+		if !joined {
+			http.Error(w, "This invite has expired or you are banned from the channel", http.StatusGone)
+			return
+		}
+		http.Redirect(w, r, "/channels/"+channel.Slug, http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Channel Channel
+		Invite  ChannelInvite
+	}{
+		Channel: channel,
+		Invite:  invite,
+	}
+
+	err = templates.ExecuteTemplate(w, "invite.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// redirectBack redirects to the page the request came from, or to fallback
+// when the Referer header is missing or points at another site.
+func redirectBack(w http.ResponseWriter, r *http.Request, fallback string) {
+	target := fallback
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" && (ref.Host == "" || ref.Host == r.Host) {
+		target = ref.RequestURI()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// JotHandler displays a single jot on its permalink page together with its nested replies.
+// A POST to the same URL adds a reply to the jot.
+func JotHandler(w http.ResponseWriter, r *http.Request) {
+	// Redirect to login page if the user is not authenticated
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Get the jot ID from the URL path
+	jotIDStr := r.URL.Path[len("/jots/"):]
+	jotID, err := strconv.Atoi(jotIDStr)
+	if err != nil {
+		http.Error(w, "Invalid jot ID", http.StatusBadRequest)
+		return
+	}
+	userID := GetAuthenticatedUserID(r)
+	if !requireJotAccess(w, r, userID, jotID) {
+		return
+	}
+
+	// Handle reply submission
+	if r.Method == "POST" {
+		r.ParseForm()
+		content := r.FormValue("content")
+		err := SaveReply(content, userID, jotID)
+		if validationErr, ok := err.(*ValidationError); ok {
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+			return
+		} else if postingErr, ok := err.(*PostingError); ok {
+			http.Error(w, postingErr.Message, http.StatusForbidden)
+			return
+		} else if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to save reply", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/jots/%d", jotID), http.StatusSeeOther)
+		return
+	}
+
+	// Fetch the jot along with every reply below it
+	jot, err := FetchThread(jotID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch the jot being replied to, if any, so the page can link back up the thread
+	var parent *Jot
+	if jot.ParentID != nil {
+		p, err := FetchJotByID(*jot.ParentID)
+		if err != nil {
+			http.Error(w, "Unable to fetch jot", http.StatusInternalServerError)
+			return
+		}
+		parent = &p
+	}
+
+	// Load the jot shared by a re-jot or quote
+	shared := []Jot{jot}
+	if err := AttachOriginals(shared, userID); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+	jot.Original = shared[0].Original
+	shown := []*Jot{&jot}
+	if jot.Original != nil {
+		shown = append(shown, jot.Original)
+	}
+
+	// Resolve the mentions shown anywhere on the page
+	mentioned := append(flattenThread(&jot), shown[1:]...)
+	if parent != nil {
+		mentioned = append(mentioned, parent)
+	}
+	if err := AttachMentions(mentioned); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+	if err := AttachAttachments(shown); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+	if err := AttachLinkPreviews(shown); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+	if err := AttachPolls([]*Jot{&jot}, userID); err != nil {
+		http.Error(w, "Unable to fetch jot details", http.StatusInternalServerError)
+		return
+	}
+
+	// Prepare data to pass to the template
+	data := struct {
+		Jot    Jot
+		Parent *Jot
+	}{
+		Jot:    jot,
+		Parent: parent,
+	}
+
+	// Render the template with the jot and its thread
+	err = templates.ExecuteTemplate(w, "jot.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// NotificationsHandler lists the user's notifications and marks them as read.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Redirect to login page if the user is not authenticated
+	if !IsAuthenticated(r) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	userID := GetAuthenticatedUserID(r)
+	notifications, err := FetchNotifications(userID)
+	if err != nil {
+		http.Error(w, "Unable to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+
+	// The notifications are being shown now, so they no longer count as unread
+	if err := MarkNotificationsRead(userID); err != nil {
+		http.Error(w, "Unable to update notifications", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Notifications []Notification
+	}{
+		Notifications: notifications,
+	}
+
+	err = templates.ExecuteTemplate(w, "notifications.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
+
+// WebSocket clients map to keep track of all connected clients and the user each one belongs to
+// (0 for anonymous connections). clientsMu guards the map, which is shared between handlers.
+var clients = make(map[*websocket.Conn]int)
+var clientsMu sync.Mutex
+
+// outbound carries messages from Redis to the WebSocket clients allowed to receive them
+var outbound = make(chan hubMessage)
+
+// sendToClients writes a message to every client whose user passes the include check
+func sendToClients(message string, include func(userID int) bool) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for client, userID := range clients {
+		if !include(userID) {
+			continue
+		}
+		err := client.WriteMessage(websocket.TextMessage, []byte(message))
+		if err != nil {
+			log.Printf("WebSocket write error: %v", err)
+			client.Close()
+			delete(clients, client)
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// WebSocketHandler handles WebSocket requests from the client
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	// Remember who owns the connection so per-user notifications can reach them
+	userID := 0
+	if IsAuthenticated(r) {
+		userID = GetAuthenticatedUserID(r)
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade to websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Add this connection to a list of active clients
+	clientsMu.Lock()
+	clients[conn] = userID
+	clientsMu.Unlock()
+
+	for {
+		// Keep the connection open
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("WebSocket read error: %v", err)
+			clientsMu.Lock()
+			delete(clients, conn)
+			clientsMu.Unlock()
+			break
+		}
+	}
+}
+
+// handleMessages listens for outbound messages and sends each one to the WebSocket clients in
+// its audience. All writes happen here so a connection never has two writers.
+func handleMessages() {
+	for message := range outbound {
+		include, err := messageAudience(message)
+		if err != nil {
+			continue
 		}
+		sendToClients(message.Message, include)
 	}
 }
@@ -0,0 +1,244 @@
+// highlight.go
+//
+// This file highlights the source code in fenced code blocks on the server,
+// so highlighted snippets need no client-side library. Each supported
+// language is described by a small table of keywords, comment markers and
+// string quotes; a single tokenizer uses it to wrap comments, strings,
+// numbers, keywords and literals in <span class="hl-..."> elements that the
+// stylesheet colors. It is deliberately approximate: it never parses the
+// code, it only has to look right for typical snippets.
+
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// syntax describes how to tokenize one language.
+type syntax struct {
+	keywords      map[string]bool // Reserved words, highlighted as hl-keyword
+	literals      map[string]bool // Constants such as true and nil, highlighted as hl-literal
+	lineComments  []string        // Markers that start a comment running to the end of the line
+	blockComment  [2]string       // Start and end of a block comment, if the language has one
+	quotes        string          // Characters that delimit strings
+	multiline     string          // Quotes whose strings may span lines (Go raw strings, JS templates)
+	tripleQuotes  bool            // Whether """ and ''' delimit multi-line strings (Python)
+	caseSensitive bool            // Whether keywords must match case (false for SQL)
+}
+
+// words builds a set from a space separated list of words.
+func words(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+	return set
+}
+
+// syntaxes maps the language names accepted after a code fence, including
+// common aliases, to their syntax. Blocks in other languages are shown plain.
+var syntaxes = func() map[string]*syntax {
+	goSyntax := &syntax{
+		keywords: words("break case chan const continue default defer else fallthrough for func go goto if " +
+			"import interface map package range return select struct switch type var " +
+			"bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string " +
+			"uint uint8 uint16 uint32 uint64 uintptr any"),
+		literals:      words("true false nil iota"),
+		lineComments:  []string{"//"},
+		blockComment:  [2]string{"/*", "*/"},
+		quotes:        "\"'`",
+		multiline:     "`",
+		caseSensitive: true,
+	}
+	javascript := &syntax{
+		keywords: words("async await break case catch class const continue debugger default delete do else " +
+			"export extends finally for from function if import in instanceof let new of return static " +
+			"super switch this throw try typeof var void while with yield interface type enum implements"),
+		literals:      words("true false null undefined NaN Infinity"),
+		lineComments:  []string{"//"},
+		blockComment:  [2]string{"/*", "*/"},
+		quotes:        "\"'`",
+		multiline:     "`",
+		caseSensitive: true,
+	}
+	python := &syntax{
+		keywords: words("and as assert async await break class continue def del elif else except finally for " +
+			"from global if import in is lambda nonlocal not or pass raise return try while with yield"),
+		literals:      words("True False None self"),
+		lineComments:  []string{"#"},
+		quotes:        "\"'",
+		tripleQuotes:  true,
+		caseSensitive: true,
+	}
+	sqlSyntax := &syntax{
+		keywords: words("select from where and or not insert into values update set delete create table alter " +
+			"drop index on join left right inner outer full cross group by order having limit offset as distinct " +
+			"union all in is like between exists case when then else end primary key foreign references unique " +
+			"default constraint asc desc with begin commit rollback"),
+		literals:     words("null true false"),
+		lineComments: []string{"--", "#"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"`",
+	}
+	shell := &syntax{
+		keywords: words("if then else elif fi for while until do done case esac in function return " +
+			"export local readonly set unset shift exit source echo cd"),
+		literals:      words("true false"),
+		lineComments:  []string{"#"},
+		quotes:        "\"'",
+		multiline:     "\"'",
+		caseSensitive: true,
+	}
+	jsonSyntax := &syntax{
+		literals:      words("true false null"),
+		quotes:        "\"",
+		caseSensitive: true,
+	}
+
+	return map[string]*syntax{
+		"go":         goSyntax,
+		"golang":     goSyntax,
+		"javascript": javascript,
+		"js":         javascript,
+		"typescript": javascript,
+		"ts":         javascript,
+		"python":     python,
+		"py":         python,
+		"sql":        sqlSyntax,
+		"mysql":      sqlSyntax,
+		"bash":       shell,
+		"sh":         shell,
+		"shell":      shell,
+		"json":       jsonSyntax,
+	}
+}()
+
+// highlightCode returns code as escaped HTML with its tokens wrapped in
+// highlighting spans. Code in an unsupported language is only escaped.
+func highlightCode(code, language string) string {
+	lang, ok := syntaxes[language]
+	if !ok {
+		return html.EscapeString(code)
+	}
+
+	var out, plain strings.Builder
+	emit := func(class, token string) {
+		out.WriteString(html.EscapeString(plain.String()))
+		plain.Reset()
+		out.WriteString(`<span class="hl-` + class + `">` + html.EscapeString(token) + `</span>`)
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		c := code[i]
+
+		if lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]) {
+			end := strings.Index(rest[len(lang.blockComment[0]):], lang.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(lang.blockComment[0]) + end + len(lang.blockComment[1])
+			}
+			emit("comment", rest[:n])
+			i += n
+			continue
+		}
+		if lang.startsLineComment(code, i) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			emit("comment", rest[:n])
+			i += n
+			continue
+		}
+		if strings.IndexByte(lang.quotes, c) >= 0 {
+			n := lang.stringLength(rest)
+			emit("string", rest[:n])
+			i += n
+			continue
+		}
+		if isDigit(c) && (i == 0 || !isWordByte(code[i-1])) {
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.' && n+1 < len(rest) && isDigit(rest[n+1])) {
+				n++
+			}
+			emit("number", rest[:n])
+			i += n
+			continue
+		}
+		if isWordByte(c) && c < 0x80 && !isDigit(c) {
+			n := 1
+			for n < len(rest) && isWordByte(rest[n]) && rest[n] < 0x80 {
+				n++
+			}
+			word := rest[:n]
+			key := word
+			if !lang.caseSensitive {
+				key = strings.ToLower(word)
+			}
+			switch {
+			case lang.keywords[key]:
+				emit("keyword", word)
+			case lang.literals[key]:
+				emit("literal", word)
+			default:
+				plain.WriteString(word)
+			}
+			i += n
+			continue
+		}
+
+		plain.WriteByte(c)
+		i++
+	}
+	out.WriteString(html.EscapeString(plain.String()))
+	return out.String()
+}
+
+// startsLineComment reports whether a line comment starts at code[i]. A "#"
+// only starts one at the beginning of a word, so shell's $# and the like
+// stay code.
+func (s *syntax) startsLineComment(code string, i int) bool {
+	for _, marker := range s.lineComments {
+		if strings.HasPrefix(code[i:], marker) {
+			if marker == "#" && i > 0 && !strings.ContainsRune(" \t\n;(", rune(code[i-1])) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// stringLength returns the length of the string literal at the start of s,
+// including its quotes. Backslash escapes are skipped, and an unterminated
+// string runs to the end of the line (or of the code, for multi-line quotes).
+func (s *syntax) stringLength(str string) int {
+	quote := str[:1]
+	if s.tripleQuotes && (strings.HasPrefix(str, `"""`) || strings.HasPrefix(str, "'''")) {
+		if end := strings.Index(str[3:], str[:3]); end >= 0 {
+			return end + 6
+		}
+		return len(str)
+	}
+
+	multiline := strings.Contains(s.multiline, quote)
+	for n := 1; n < len(str); n++ {
+		switch str[n] {
+		case '\\':
+			n++
+		case '\n':
+			if !multiline {
+				return n
+			}
+		case quote[0]:
+			return n + 1
+		}
+	}
+	return len(str)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,243 @@
+// images.go
+//
+// This file holds the image processing shared by uploads: checking that an
+// upload really is a PNG, JPEG, GIF or WebP image of a sane size, decoding it,
+// and cropping and resizing it in pure Go. Images are always re-encoded
+// before they are stored, so nothing but pixels survives from the upload.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	_ "image/gif" // Register the GIF decoder
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Register the WebP decoder
+)
+
+// maxImagePixels bounds the decoded size of an upload (about 40 megapixels),
+// so a small compressed file can't expand into gigabytes of memory.
+const maxImagePixels = 40_000_000
+
+// imageTypes maps the content types accepted for image uploads to the format
+// names the image package reports for them.
+var imageTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// UploadError is returned when an uploaded image or file is rejected. Its
+// message is meant to be shown to the user.
+type UploadError struct {
+	Message string
+}
+
+func (e *UploadError) Error() string {
+	return e.Message
+}
+
+// readUpload reads at most maxBytes from an upload. It returns an
+// *UploadError if the upload is empty or larger than that.
+func readUpload(r io.Reader, maxBytes int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, &UploadError{"The uploaded file is empty"}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, &UploadError{fmt.Sprintf("Uploads must be at most %d MB", maxBytes>>20)}
+	}
+	return data, nil
+}
+
+// decodeImage decodes an uploaded image after checking its type from its
+// contents (not its name or the type the browser claimed) and its
+// dimensions from its header. Animated GIFs decode to their first frame.
+func decodeImage(data []byte) (image.Image, error) {
+	format, ok := imageTypes[http.DetectContentType(data)]
+	if !ok {
+		return nil, &UploadError{"Only PNG, JPEG, GIF and WebP images are supported"}
+	}
+
+	config, configFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || configFormat != format {
+		return nil, &UploadError{"The uploaded image could not be read"}
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, &UploadError{"The uploaded image is too large"}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &UploadError{"The uploaded image could not be read"}
+	}
+	return img, nil
+}
+
+// cropSquare returns the largest centered square of img.
+func cropSquare(img image.Image) image.Image {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, image.Pt(x, y), draw.Src)
+	return square
+}
+
+// resizeImage scales img to width x height with Catmull-Rom resampling.
+func resizeImage(img image.Image, width, height int) image.Image {
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return resized
+}
+
+// encodePNG encodes img as a PNG.
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fitWithin scales img down so neither side exceeds maxPixels, keeping its
+// aspect ratio. Images that already fit are returned unchanged.
+func fitWithin(img image.Image, maxPixels int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= maxPixels && height <= maxPixels {
+		return img
+	}
+	if width >= height {
+		return resizeImage(img, maxPixels, max(1, height*maxPixels/width))
+	}
+	return resizeImage(img, max(1, width*maxPixels/height), maxPixels)
+}
+
+// encodeJPEG encodes img as a JPEG with the given quality (1-100).
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) stored in a JPEG, or 1
+// (upright) if it has none. Phones store photos as the sensor saw them and
+// record how to rotate them in this tag, so it has to be applied before the
+// metadata is dropped.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	// Walk the segments before the image data looking for the APP1 Exif segment
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan or end of image: no more metadata
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF
+// structure, the format EXIF data is stored in.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation returns img turned upright according to an EXIF
+// orientation: mirrored for 2 and 4, rotated for 3, 6 and 8, and both for 5 and 7.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal
+				sx, sy = y, x
+			case 6: // Needs a 90° clockwise turn
+				sx, sy = y, h-1-x
+			case 7: // Mirrored along the top-right diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // Needs a 90° counter-clockwise turn
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
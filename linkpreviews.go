@@ -0,0 +1,436 @@
+// linkpreviews.go
+//
+// This file generates preview cards for the first link in a jot. Saving a
+// jot only queues the link; background workers fetch the page, read its
+// OpenGraph and Twitter card metadata, and push a preview.ready event when
+// the card is ready, so posting is never slowed down by a slow site.
+//
+// Fetching arbitrary URLs from the server is dangerous, so every connection
+// is checked against the address actually dialed (after DNS resolution and on
+// every redirect) and refused for loopback, private and other internal
+// ranges. Responses are bounded in time and size. Results, including
+// failures, are cached per URL so popular links are fetched once.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Link preview limits
+const (
+	previewFetchTimeout  = 5 * time.Second
+	maxPreviewBodyBytes  = 512 << 10 // Metadata is in the <head>, so the start of the page is enough
+	maxPreviewRedirects  = 5
+	maxPreviewURLLength  = 2048
+	maxPreviewTitle      = 300
+	maxPreviewText       = 500
+	previewCacheTTL      = 24 * time.Hour // How long a fetched preview is reused
+	previewFailureTTL    = time.Hour      // How long a failed fetch is remembered
+	previewWorkers       = 4
+	previewQueueCapacity = 100
+)
+
+// linkPattern matches http and https URLs in jot text.
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// LinkPreview is the card shown under a jot for the first link in its text.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image_url"` // Empty if the page has no image
+	SiteName    string `json:"site_name"` // The page's host if it doesn't name itself
+}
+
+// previewJob is a jot waiting for its link preview.
+type previewJob struct {
+	JotID     int64
+	ChannelID int // 0 if the jot is not in a channel
+	URL       string
+}
+
+// previewQueue holds the jots whose links the workers still have to preview.
+var previewQueue = make(chan previewJob, previewQueueCapacity)
+
+// errBlockedAddress is returned when a link resolves to an internal address.
+var errBlockedAddress = errors.New("link preview: address not allowed")
+
+// previewClient fetches pages for previews. It ignores proxy settings and
+// checks every address it connects to, so neither redirects nor DNS tricks
+// can make it reach internal services.
+var previewClient = &http.Client{
+	Timeout: previewFetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: previewFetchTimeout,
+			Control: checkPreviewAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   previewFetchTimeout,
+		ResponseHeaderTimeout: previewFetchTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxPreviewRedirects {
+			return errors.New("link preview: too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("link preview: unsupported redirect")
+		}
+		return nil
+	},
+}
+
+// Host returns the host name of the previewed link.
+func (p LinkPreview) Host() string {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// FirstLink returns the first http or https link in a jot's text, or "" if it has none.
+func FirstLink(text string) string {
+	match := linkPattern.FindString(text)
+	// Punctuation at the end of a link usually ends the sentence, not the URL
+	match = strings.TrimRight(match, ".,;:!?)]}")
+	if match == "" || len(match) > maxPreviewURLLength {
+		return ""
+	}
+	u, err := url.Parse(match)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return match
+}
+
+// QueueLinkPreview queues the first link of a newly saved jot for a preview.
+// It never blocks: when the workers are too far behind, the jot goes without.
+func QueueLinkPreview(jotID int64, channelID *int, text string) {
+	link := FirstLink(text)
+	if link == "" {
+		return
+	}
+	job := previewJob{JotID: jotID, URL: link}
+	if channelID != nil {
+		job.ChannelID = *channelID
+	}
+	select {
+	case previewQueue <- job:
+	default:
+		log.Printf("Link preview queue full, skipping jot %d", jotID)
+	}
+}
+
+// startLinkPreviewWorkers starts the goroutines that generate queued link previews.
+func startLinkPreviewWorkers() {
+	for i := 0; i < previewWorkers; i++ {
+		go func() {
+			for job := range previewQueue {
+				generateLinkPreview(job)
+			}
+		}()
+	}
+}
+
+// generateLinkPreview fetches or reuses the preview for a job's link, links it
+// to the jot and tells the jot's readers about it.
+func generateLinkPreview(job previewJob) {
+	hash := linkHash(job.URL)
+	preview, ok, fresh, err := cachedLinkPreview(hash)
+	if err != nil {
+		return
+	}
+	if !fresh {
+		var fetchErr error
+		preview, fetchErr = fetchLinkPreview(job.URL)
+		ok = fetchErr == nil
+		if fetchErr != nil {
+			log.Printf("Error fetching link preview for %s: %v", job.URL, fetchErr)
+		}
+		if err := saveLinkPreview(hash, job.URL, preview, ok); err != nil {
+			return
+		}
+	}
+
+	// The jot may have been removed while its link was fetched
+	_, err = db.Exec("INSERT IGNORE INTO content_link_previews (content_id, url_hash) SELECT id, ? FROM content WHERE id = ?", hash, job.JotID)
+	if err != nil {
+		log.Printf("Error linking preview: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	PublishEvent(Event{Type: EventLinkPreviewReady, JotID: int(job.JotID), Data: preview, ChannelID: job.ChannelID})
+}
+
+// linkHash returns the key link previews are cached under.
+func linkHash(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedLinkPreview looks up a cached preview. ok reports whether the cached
+// fetch succeeded, and fresh whether the entry is recent enough to reuse.
+func cachedLinkPreview(hash string) (preview LinkPreview, ok, fresh bool, err error) {
+	var age int
+	err = db.QueryRow(`
+        SELECT url, title, description, image_url, site_name, ok, TIMESTAMPDIFF(SECOND, fetched_at, NOW())
+        FROM link_previews
+        WHERE url_hash = ?
+    `, hash).Scan(&preview.URL, &preview.Title, &preview.Description, &preview.ImageURL, &preview.SiteName, &ok, &age)
+	if err == sql.ErrNoRows {
+		return preview, false, false, nil
+	} else if err != nil {
+		log.Printf("Error retrieving link preview: %v", err)
+		return preview, false, false, err
+	}
+
+	ttl := previewCacheTTL
+	if !ok {
+		ttl = previewFailureTTL
+	}
+	return preview, ok, time.Duration(age)*time.Second < ttl, nil
+}
+
+// saveLinkPreview caches the result of fetching a link.
+func saveLinkPreview(hash, link string, preview LinkPreview, ok bool) error {
+	_, err := db.Exec(`
+        INSERT INTO link_previews (url_hash, url, title, description, image_url, site_name, ok)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE title = VALUES(title), description = VALUES(description), image_url = VALUES(image_url),
+                                site_name = VALUES(site_name), ok = VALUES(ok), fetched_at = CURRENT_TIMESTAMP
+    `, hash, link, preview.Title, preview.Description, preview.ImageURL, preview.SiteName, ok)
+	if err != nil {
+		log.Printf("Error saving link preview: %v", err)
+	}
+	return err
+}
+
+// fetchLinkPreview downloads the start of an HTML page and reads its preview
+// metadata. Pages without a title can't make a useful card and count as failures.
+func fetchLinkPreview(link string) (LinkPreview, error) {
+	preview := LinkPreview{URL: link}
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "JotsLinkPreview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, fmt.Errorf("not an HTML page: %q", mediaType)
+	}
+
+	meta, title := readPageMetadata(io.LimitReader(resp.Body, maxPreviewBodyBytes))
+	preview.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"], title)
+	preview.Description = firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"])
+	preview.SiteName = firstNonEmpty(meta["og:site_name"], resp.Request.URL.Hostname())
+	if image := firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"], meta["twitter:image:src"]); image != "" {
+		// Relative image URLs are relative to the page we ended up on after redirects
+		if u, err := resp.Request.URL.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.String()) <= maxPreviewURLLength {
+			preview.ImageURL = u.String()
+		}
+	}
+
+	preview.Title = truncateText(preview.Title, maxPreviewTitle)
+	preview.Description = truncateText(preview.Description, maxPreviewText)
+	preview.SiteName = truncateText(preview.SiteName, maxPreviewTitle)
+	if preview.Title == "" {
+		return preview, errors.New("page has no title")
+	}
+	return preview, nil
+}
+
+// readPageMetadata reads the <meta> tags and <title> of an HTML page, up to
+// the start of its <body>. Meta tags are keyed by their lowercased property
+// or name attribute; the first occurrence of each wins.
+func readPageMetadata(r io.Reader) (map[string]string, string) {
+	meta := make(map[string]string)
+	var title strings.Builder
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta, title.String()
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				return meta, title.String()
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				return meta, title.String()
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var attr, value []byte
+					attr, value, hasAttr = tokenizer.TagAttr()
+					switch string(attr) {
+					case "property", "name":
+						key = strings.ToLower(string(value))
+					case "content":
+						content = string(value)
+					}
+				}
+				if _, seen := meta[key]; key != "" && !seen {
+					meta[key] = content
+				}
+			}
+		}
+	}
+}
+
+// firstNonEmpty returns the first of values that isn't blank, trimmed.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// truncateText collapses whitespace in page metadata, replaces invalid UTF-8
+// and cuts it to at most limit characters.
+func truncateText(text string, limit int) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if utf8.RuneCountInString(text) > limit {
+		text = strings.TrimSpace(string([]rune(text)[:limit-1])) + "…"
+	}
+	return text
+}
+
+// checkPreviewAddress refuses connections to addresses that are not on the
+// public internet. It runs for every connection the preview client makes,
+// after DNS resolution, so it sees the address actually dialed.
+func checkPreviewAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isPublicAddress(addr) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// nonPublicPrefixes are ranges not covered by the netip.Addr predicates that
+// must not be reachable either.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can reach private IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // Documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4, which embeds IPv4 addresses
+}
+
+// isPublicAddress reports whether addr is a global unicast address outside
+// every private, loopback, link-local and reserved range.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// AttachLinkPreviews fills in the Preview of every jot whose link has a
+// successfully fetched preview, with a single query.
+func AttachLinkPreviews(jots []*Jot) error {
+	if len(jots) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(jots))
+	for i, jot := range jots {
+		ids[i] = jot.ID
+	}
+	placeholders, args := inClause(ids)
+	rows, err := db.Query(`
+        SELECT content_link_previews.content_id, link_previews.url, link_previews.title,
+               link_previews.description, link_previews.image_url, link_previews.site_name
+        FROM content_link_previews
+        JOIN link_previews ON link_previews.url_hash = content_link_previews.url_hash
+        WHERE link_previews.ok AND content_link_previews.content_id IN (`+placeholders+`)
+    `, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	byJot := make(map[int]*LinkPreview)
+	for rows.Next() {
+		var jotID int
+		var preview LinkPreview
+		if err := rows.Scan(&jotID, &preview.URL, &preview.Title, &preview.Description, &preview.ImageURL, &preview.SiteName); err != nil {
+			log.Printf("Scan error: %v", err)
+			return err
+		}
+		byJot[jotID] = &preview
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+
+	for _, jot := range jots {
+		jot.Preview = byJot[jot.ID]
+	}
+	return nil
+}
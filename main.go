@@ -11,21 +11,51 @@ import (
 )
 
 func main() {
+	// Connect to MySQL and Redis before anything uses them
+	connectDB()
+	connectRedis()
+
 	// Serve static files from the "static" directory
 	// Accessible via URLs starting with "/static/"
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	// Serve uploaded files such as avatars when they are stored on this server
+	if handler, ok := blobs.(http.Handler); ok {
+		http.Handle("/media/", http.StripPrefix("/media", handler))
+	}
+
 	// Define route handlers
 	// Each handler corresponds to a specific URL path
-	http.HandleFunc("/", HomeHandler)                        // Home page showing all jots
-	http.HandleFunc("/login", LoginHandler)                  // Login page for user authentication
-	http.HandleFunc("/signup", SignupHandler)                // Signup page for new user registration
-	http.HandleFunc("/dashboard", DashboardHandler)          // Dashboard for submitting new content
-	http.HandleFunc("/channels", ChannelsHandler)            // New Channels route
-	http.HandleFunc("/follow-channel", FollowChannelHandler) // New follow/unfollow route
-	http.HandleFunc("/logout", LogoutHandler)                // Logout route to clear user session
-	http.HandleFunc("/channels/", ChannelJotsHandler)        // Add this to handle specific channels
-	http.HandleFunc("/ws", WebSocketHandler)                 // WebSocket handler
+	http.HandleFunc("/", HomeHandler)                          // Home page showing all jots
+	http.HandleFunc("/login", LoginHandler)                    // Login page for user authentication
+	http.HandleFunc("/signup", SignupHandler)                  // Signup page for new user registration
+	http.HandleFunc("/dashboard", DashboardHandler)            // Dashboard for submitting new content
+	http.HandleFunc("/preview", PreviewHandler)                // Render composer text as it would be posted
+	http.HandleFunc("/scheduled", ScheduledHandler)            // List, edit and cancel scheduled jots
+	http.HandleFunc("/api/drafts", DraftsAPIHandler)           // Autosaved drafts as JSON
+	http.HandleFunc("/api/drafts/", DraftsAPIHandler)          // A single draft as JSON
+	http.HandleFunc("/channels", ChannelsHandler)              // New Channels route
+	http.HandleFunc("/follow-channel", FollowChannelHandler)   // New follow/unfollow route
+	http.HandleFunc("/logout", LogoutHandler)                  // Logout route to clear user session
+	http.HandleFunc("/channels/", ChannelJotsHandler)          // Add this to handle specific channels
+	http.HandleFunc("/channels/new", CreateChannelHandler)     // Create a new channel
+	http.HandleFunc("/edit-channel", EditChannelHandler)       // Rename/describe a channel (owner only)
+	http.HandleFunc("/join-channel", JoinChannelHandler)       // Ask to join a private channel
+	http.HandleFunc("/channel-members", ChannelMembersHandler) // Members, roles, bans and invites (owner and moderators)
+	http.HandleFunc("/remove-jot", RemoveJotHandler)           // Remove a jot from a channel (moderators)
+	http.HandleFunc("/pin", PinHandler)                        // Pin, unpin and reorder jots in a channel (moderators)
+	http.HandleFunc("/invite/", InviteHandler)                 // Join a channel through an invite link
+	http.HandleFunc("/jots/", JotHandler)                      // Permalink page with a jot's reply thread
+	http.HandleFunc("/notifications", NotificationsHandler)    // Notifications for the logged in user
+	http.HandleFunc("/react", ReactHandler)                    // Add/remove a reaction on a jot
+	http.HandleFunc("/vote", VoteHandler)                      // Vote in a jot's poll
+	http.HandleFunc("/share", ShareHandler)                    // Re-jot or quote a jot
+	http.HandleFunc("/tags/", TagHandler)                      // Jots tagged with a hashtag
+	http.HandleFunc("/u/", ProfileHandler)                     // User profile pages
+	http.HandleFunc("/follow-user", FollowUserHandler)         // Follow/unfollow another user
+	http.HandleFunc("/settings", SettingsHandler)              // Edit the logged in user's profile
+	http.HandleFunc("/identicons/", IdenticonHandler)          // Generated avatars for users without an upload
+	http.HandleFunc("/ws", WebSocketHandler)                   // WebSocket handler
 
 	// Start WebSocket broadcast handler
 	go handleMessages()
@@ -33,6 +63,15 @@ func main() {
 	// Start Redis subscriber in a Goroutine
 	go startRedisSubscriber()
 
+	// Start the workers that fetch link previews for new jots
+	startLinkPreviewWorkers()
+
+	// Start the worker that publishes scheduled jots when they are due
+	startScheduledJotWorker()
+
+	// Start the reaper that deletes ephemeral jots once they expire
+	startExpiredJotReaper()
+
 	// Start the HTTP server on port 8080
 	// ListenAndServe blocks and waits for incoming requests
 	fmt.Println("Starting server at :8080")
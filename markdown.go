@@ -0,0 +1,323 @@
+// markdown.go
+//
+// This file renders the small Markdown subset jots may use: **bold**,
+// *italics*, `inline code`, fenced code blocks (highlighted by highlight.go),
+// [links](https://...) and bulleted or numbered lists. There is no raw HTML:
+// every character of the text is escaped, and the only markup in the output
+// is what the renderer writes itself, with link targets limited to http,
+// https and mailto URLs.
+// Hashtags and resolved @mentions are linked in ordinary text, but not
+// inside code or link text.
+//
+// The rendered HTML is cached in content.rendered_html when a jot is saved,
+// tagged with renderVersion so changes to the renderer invalidate old caches.
+
+package main
+
+import (
+	"database/sql"
+	"html"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderVersion identifies the output of RenderMarkdown. Bump it whenever the
+// generated HTML changes, so cached renderings from older versions are ignored.
+const renderVersion = 2
+
+// collapsedCodeLines is the most lines a code block may have before timelines
+// show it collapsed, with a button to expand it.
+const collapsedCodeLines = 12
+
+// Block level patterns
+var (
+	bulletItemPattern   = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	numberedItemPattern = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+	fencePattern        = regexp.MustCompile("^\\s{0,3}```\\s*([A-Za-z0-9_+#.-]*)\\s*$")
+)
+
+// RenderMarkdown renders jot text to sanitized HTML. mentions are the
+// usernames resolved from the text's @mentions; other mentions stay plain text.
+func RenderMarkdown(text string, mentions []string) string {
+	resolved := make(map[string]string, len(mentions))
+	for _, username := range mentions {
+		resolved[strings.ToLower(username)] = username
+	}
+	r := &markdownRenderer{mentions: resolved}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case fencePattern.MatchString(line):
+			i = r.codeBlock(lines, i)
+		case bulletItemPattern.MatchString(line):
+			i = r.list(lines, i, "ul", bulletItemPattern)
+		case numberedItemPattern.MatchString(line):
+			i = r.list(lines, i, "ol", numberedItemPattern)
+		default:
+			i = r.paragraph(lines, i)
+		}
+	}
+	return r.out.String()
+}
+
+// markdownRenderer accumulates the HTML of one jot.
+type markdownRenderer struct {
+	out      strings.Builder
+	mentions map[string]string // Lowercased username -> username, for resolved mentions
+}
+
+// codeBlock renders a fenced code block starting at lines[start] and returns
+// the index of the first line after it. An unclosed fence runs to the end.
+// Code in a supported language is highlighted (see highlight.go), and long
+// blocks are marked so timelines can show them collapsed.
+func (r *markdownRenderer) codeBlock(lines []string, start int) int {
+	language := strings.ToLower(fencePattern.FindStringSubmatch(lines[start])[1])
+	end := start + 1
+	for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+		end++
+	}
+	code := lines[start+1 : min(end, len(lines))]
+
+	class := "code-block"
+	if len(code) > collapsedCodeLines {
+		class += " code-long"
+	}
+	r.out.WriteString(`<div class="` + class + `">`)
+	r.out.WriteString(`<div class="code-toolbar">`)
+	if language != "" {
+		r.out.WriteString(`<span class="code-language">` + html.EscapeString(language) + `</span>`)
+	}
+	r.out.WriteString(`<button type="button" class="code-copy">Copy</button></div>`)
+
+	r.out.WriteString("<pre><code")
+	if language != "" {
+		r.out.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+	}
+	r.out.WriteString(">")
+	r.out.WriteString(highlightCode(strings.Join(code, "\n"), language))
+	r.out.WriteString("</code></pre>")
+
+	if len(code) > collapsedCodeLines {
+		r.out.WriteString(`<button type="button" class="code-expand">Show all ` + strconv.Itoa(len(code)) + ` lines</button>`)
+	}
+	r.out.WriteString("</div>\n")
+
+	if end < len(lines) {
+		end++ // Skip the closing fence
+	}
+	return end
+}
+
+// list renders consecutive list items matching pattern as a tag ("ul" or
+// "ol") list and returns the index of the first line after it.
+func (r *markdownRenderer) list(lines []string, start int, tag string, pattern *regexp.Regexp) int {
+	r.out.WriteString("<" + tag + ">\n")
+	i := start
+	for ; i < len(lines); i++ {
+		match := pattern.FindStringSubmatch(lines[i])
+		if match == nil {
+			break
+		}
+		r.out.WriteString("<li>" + r.inline(match[1], true) + "</li>\n")
+	}
+	r.out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// paragraph renders consecutive lines of text as one paragraph, keeping the
+// line breaks, and returns the index of the first line after it.
+func (r *markdownRenderer) paragraph(lines []string, start int) int {
+	var rendered []string
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" || fencePattern.MatchString(line) ||
+			bulletItemPattern.MatchString(line) || numberedItemPattern.MatchString(line) {
+			break
+		}
+		rendered = append(rendered, r.inline(strings.TrimSpace(line), true))
+	}
+	r.out.WriteString("<p>" + strings.Join(rendered, "<br>\n") + "</p>\n")
+	return i
+}
+
+// inline renders the inline syntax of a single line. Links are only
+// recognized when allowLinks is set, so link text can't nest another link.
+func (r *markdownRenderer) inline(text string, allowLinks bool) string {
+	var out, plain strings.Builder
+	flush := func() {
+		out.WriteString(r.decorate(plain.String(), allowLinks))
+		plain.Reset()
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte("\\`*_[]()#@", text[i+1]) >= 0:
+			// An escaped character is always literal, and never starts a tag or mention
+			flush()
+			out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(text[i+1:], '`'); end > 0 {
+				flush()
+				out.WriteString("<code>" + html.EscapeString(text[i+1:i+1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(text[i:], "**"):
+			if inner, ok := delimited(text[i+2:], "**"); ok {
+				flush()
+				out.WriteString("<strong>" + r.inline(inner, allowLinks) + "</strong>")
+				i += len(inner) + 4
+				continue
+			}
+
+		case c == '*' || c == '_':
+			// Underscores only emphasize at word boundaries, so snake_case and
+			// @user_names stay intact
+			if c == '*' || i == 0 || !isWordByte(text[i-1]) {
+				if inner, ok := delimited(text[i+1:], string(c)); ok && (c == '*' || !endsInWord(text, i+len(inner)+2)) {
+					flush()
+					out.WriteString("<em>" + r.inline(inner, allowLinks) + "</em>")
+					i += len(inner) + 2
+					continue
+				}
+			}
+
+		case c == '[' && allowLinks:
+			if label, target, n, ok := parseLink(text[i:]); ok {
+				flush()
+				out.WriteString(`<a href="` + html.EscapeString(target) + `" rel="nofollow noopener">` + r.inline(label, false) + `</a>`)
+				i += n
+				continue
+			}
+		}
+		plain.WriteByte(c)
+		i++
+	}
+	flush()
+	return out.String()
+}
+
+// decorate escapes plain text and links its hashtags and resolved mentions.
+// Inside link text (allowLinks false) it only escapes.
+func (r *markdownRenderer) decorate(text string, allowLinks bool) string {
+	escaped := html.EscapeString(text)
+	if !allowLinks {
+		return escaped
+	}
+	linked := tagPattern.ReplaceAllStringFunc(escaped, func(match string) string {
+		parts := tagPattern.FindStringSubmatch(match)
+		return parts[1] + `<a class="tag" href="/tags/` + url.PathEscape(strings.ToLower(parts[2])) + `">#` + parts[2] + `</a>`
+	})
+	if len(r.mentions) == 0 {
+		return linked
+	}
+	return mentionPattern.ReplaceAllStringFunc(linked, func(match string) string {
+		parts := mentionPattern.FindStringSubmatch(match)
+		username, ok := r.mentions[strings.ToLower(parts[2])]
+		if !ok {
+			return match
+		}
+		return parts[1] + `<a class="mention" href="/u/` + url.PathEscape(username) + `">@` + parts[2] + `</a>`
+	})
+}
+
+// delimited returns the text before the closing delimiter in s, if there is
+// a non-empty run that neither starts nor ends with a space.
+func delimited(s, delimiter string) (string, bool) {
+	end := strings.Index(s, delimiter)
+	if end <= 0 {
+		return "", false
+	}
+	inner := s[:end]
+	if strings.TrimSpace(inner) != inner {
+		return "", false
+	}
+	return inner, true
+}
+
+// parseLink parses "[label](target)" at the start of s. It returns the
+// length of the whole construct, and fails for targets that are not
+// absolute http, https or mailto URLs.
+func parseLink(s string) (label, target string, n int, ok bool) {
+	closeLabel := strings.Index(s, "](")
+	if closeLabel <= 1 {
+		return "", "", 0, false
+	}
+	closeTarget := strings.IndexByte(s[closeLabel+2:], ')')
+	if closeTarget <= 0 {
+		return "", "", 0, false
+	}
+	label = s[1:closeLabel]
+	target = strings.TrimSpace(s[closeLabel+2 : closeLabel+2+closeTarget])
+
+	u, err := url.Parse(target)
+	if err != nil || strings.ContainsAny(target, " \t") {
+		return "", "", 0, false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", "", 0, false
+		}
+	case "mailto":
+	default:
+		return "", "", 0, false
+	}
+	return label, target, closeLabel + 3 + closeTarget, true
+}
+
+// isWordByte reports whether b is an ASCII letter, digit or underscore, or
+// part of a multi-byte (non-ASCII) character.
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b >= 0x80
+}
+
+// endsInWord reports whether the byte at i continues a word.
+func endsInWord(text string, i int) bool {
+	return i < len(text) && isWordByte(text[i])
+}
+
+// cacheRenderedText renders a saved jot's text with its resolved mentions and
+// stores the HTML next to the raw text.
+func cacheRenderedText(jotID int64, text string) error {
+	jot := Jot{ID: int(jotID), Text: text}
+	if err := AttachMentions([]*Jot{&jot}); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE content SET rendered_html = ?, render_version = ? WHERE id = ?",
+		RenderMarkdown(text, jot.Mentions), renderVersion, jotID)
+	if err != nil {
+		log.Printf("Error caching rendered jot: %v", err)
+	}
+	return err
+}
+
+// PreviewMarkdown renders text as it would look once posted, resolving its
+// mentions against the users table.
+func PreviewMarkdown(text string) (string, error) {
+	var mentions []string
+	for _, name := range ExtractMentions(text) {
+		var username string
+		err := db.QueryRow("SELECT username FROM users WHERE username = ?", name).Scan(&username)
+		if err == nil {
+			mentions = append(mentions, username)
+		} else if err != sql.ErrNoRows {
+			log.Printf("Error resolving mention: %v", err)
+			return "", err
+		}
+	}
+	return RenderMarkdown(text, mentions), nil
+}
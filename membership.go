@@ -0,0 +1,437 @@
+// membership.go
+//
+// This file handles channel visibility and membership. Channels are public,
+// private or invite-only:
+//
+//   - public channels can be read by every logged in user
+//   - private channels are listed, but only members can read them; other users
+//     can ask to join and the owner approves or rejects the request
+//   - invite-only channels are hidden from non-members and can only be joined
+//     through an invite link
+//
+// Membership is separate from following: following only controls what shows up
+// for a user, membership controls what they are allowed to see. Access checks
+// go through Authorize (see roles.go), CanViewJot or visibleJotsClause.
+
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// Channel visibility levels stored in channels.visibility
+const (
+	VisibilityPublic     = "public"
+	VisibilityPrivate    = "private"
+	VisibilityInviteOnly = "invite"
+)
+
+// visibleJotsClause restricts a jot query to jots the user may read: jots outside
+// any channel, and jots in public channels or channels the user is a member of,
+// unless the user is banned from the channel. It is the SQL form of the
+// ActionReadChannel rule in permits, and takes the user's ID twice.
+const visibleJotsClause = `(content.channel_id IS NULL OR EXISTS (
+            SELECT 1 FROM channels AS vc
+            WHERE vc.id = content.channel_id
+              AND (vc.visibility = 'public' OR EXISTS (
+                  SELECT 1 FROM channel_members AS vm WHERE vm.channel_id = vc.id AND vm.user_id = ?))
+              AND NOT EXISTS (
+                  SELECT 1 FROM channel_bans AS vb WHERE vb.channel_id = vc.id AND vb.user_id = ?))
+        )`
+
+// IsValidVisibility reports whether v is one of the supported visibility levels.
+func IsValidVisibility(v string) bool {
+	return v == VisibilityPublic || v == VisibilityPrivate || v == VisibilityInviteOnly
+}
+
+// IsChannelMember checks if a user is a member of a channel.
+func IsChannelMember(userID, channelID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM channel_members WHERE user_id = ? AND channel_id = ?)", userID, channelID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking channel membership: %v", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// CanViewJot checks if a user may read a jot, based on the channel it was posted in.
+// It returns sql.ErrNoRows if the jot does not exist.
+func CanViewJot(userID, jotID int) (bool, error) {
+	channelID, err := jotChannelID(jotID)
+	if err != nil {
+		return false, err
+	}
+	if channelID == 0 {
+		return true, nil
+	}
+	return Authorize(userID, channelID, ActionReadChannel)
+}
+
+// FetchChannelForUser retrieves a channel by its ID along with the user's
+// role, ban and pending join request. It returns sql.ErrNoRows if the
+// channel does not exist.
+func FetchChannelForUser(channelID, userID int) (Channel, error) {
+	channel, err := FetchChannel(channelID)
+	if err != nil {
+		return channel, err
+	}
+	access, err := loadChannelAccess(userID, channelID)
+	if err != nil {
+		return channel, err
+	}
+	channel.Role = access.Role
+	channel.IsMember = access.Role != ""
+	channel.IsBanned = access.Banned
+	if channel.HasRequested, err = HasRequestedToJoin(channelID, userID); err != nil {
+		return channel, err
+	}
+	return channel, nil
+}
+
+// jotChannelID returns the ID of the channel a jot was posted in, or 0 if none.
+// It returns sql.ErrNoRows if the jot does not exist.
+func jotChannelID(jotID int) (int, error) {
+	var channelID sql.NullInt64
+	err := db.QueryRow("SELECT channel_id FROM content WHERE id = ?", jotID).Scan(&channelID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving jot channel: %v", err)
+		}
+		return 0, err
+	}
+	return int(channelID.Int64), nil
+}
+
+// AddChannelMember makes a user a member of a channel with the given role.
+// Adding an existing member is a no-op and keeps their current role.
+// Any pending join request from the user is cleared.
+func AddChannelMember(channelID, userID int, role string) error {
+	_, err := db.Exec("INSERT IGNORE INTO channel_members (channel_id, user_id, role) VALUES (?, ?, ?)", channelID, userID, role)
+	if err != nil {
+		log.Printf("Error adding channel member: %v", err)
+		return err
+	}
+	_, err = db.Exec("DELETE FROM channel_join_requests WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error clearing join request: %v", err)
+	}
+	return err
+}
+
+// RemoveChannelMember removes a user from a channel on behalf of actorID and
+// records it in the audit log. Their follow is removed as well, since they can
+// no longer read the channel. Removing a non-member is a no-op.
+func RemoveChannelMember(channelID, actorID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error removing channel member: %v", err)
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &userID, AuditMemberRemoved, ""); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing member removal: %v", err)
+		return err
+	}
+	return ToggleFollowChannel(userID, channelID, false)
+}
+
+// ChannelMember is a member of a channel as listed on the members page.
+type ChannelMember struct {
+	UserID   int
+	Username string
+	Role     string // One of the Role* constants; empty for join requests and bans
+	JoinedAt time.Time
+}
+
+// FetchChannelMembers retrieves the members of a channel, in the order they joined.
+func FetchChannelMembers(channelID int) ([]ChannelMember, error) {
+	return fetchChannelUsers(`
+        SELECT users.id, users.username, channel_members.role, DATE_FORMAT(channel_members.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM channel_members
+        JOIN users ON users.id = channel_members.user_id
+        WHERE channel_members.channel_id = ?
+        ORDER BY channel_members.created_at, users.username
+    `, channelID)
+}
+
+// FetchJoinRequests retrieves the pending join requests of a channel, oldest first.
+// JoinedAt holds the time of the request.
+func FetchJoinRequests(channelID int) ([]ChannelMember, error) {
+	return fetchChannelUsers(`
+        SELECT users.id, users.username, '', DATE_FORMAT(channel_join_requests.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM channel_join_requests
+        JOIN users ON users.id = channel_join_requests.user_id
+        WHERE channel_join_requests.channel_id = ?
+        ORDER BY channel_join_requests.created_at, users.username
+    `, channelID)
+}
+
+// fetchChannelUsers runs a query selecting user ID, username, role and a timestamp.
+func fetchChannelUsers(query string, channelID int) ([]ChannelMember, error) {
+	rows, err := db.Query(query, channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []ChannelMember
+	for rows.Next() {
+		var member ChannelMember
+		var joinedAtStr string
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &joinedAtStr); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		member.JoinedAt, err = time.Parse("2006-01-02 15:04:05", joinedAtStr)
+		if err != nil {
+			log.Printf("Time parse error: %v", err)
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return members, nil
+}
+
+// RequestToJoinChannel records a user's request to join a private channel and
+// notifies the channel owner. Repeating a pending request is a no-op.
+func RequestToJoinChannel(channelID, userID int) error {
+	res, err := db.Exec("INSERT IGNORE INTO channel_join_requests (channel_id, user_id) VALUES (?, ?)", channelID, userID)
+	if err != nil {
+		log.Printf("Error saving join request: %v", err)
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+
+	channel, err := FetchChannel(channelID)
+	if err != nil || channel.OwnerID == 0 {
+		return err
+	}
+	username, err := GetUsernameByID(userID)
+	if err != nil {
+		return err
+	}
+	return CreateNotification(channel.OwnerID, userID, "join_request", 0, username+" asked to join "+channel.Name)
+}
+
+// HasRequestedToJoin checks if a user has a pending request to join a channel.
+func HasRequestedToJoin(channelID, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM channel_join_requests WHERE channel_id = ? AND user_id = ?)", channelID, userID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking join request: %v", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// ApproveJoinRequest accepts a user's pending request to join a channel on
+// behalf of actorID, making them a member, and records it in the audit log.
+// It returns sql.ErrNoRows if the user has no pending request.
+func ApproveJoinRequest(channelID, actorID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM channel_join_requests WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error clearing join request: %v", err)
+		return err
+	}
+	if err = requireAffected(res); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT IGNORE INTO channel_members (channel_id, user_id, role) VALUES (?, ?, ?)", channelID, userID, RoleMember); err != nil {
+		log.Printf("Error adding channel member: %v", err)
+		return err
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &userID, AuditMemberApproved, ""); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing join approval: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RejectJoinRequest discards a user's pending request to join a channel.
+func RejectJoinRequest(channelID, userID int) error {
+	_, err := db.Exec("DELETE FROM channel_join_requests WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error rejecting join request: %v", err)
+	}
+	return err
+}
+
+// ChannelInvite is an invite link for a channel.
+type ChannelInvite struct {
+	Token     string
+	ChannelID int
+	ExpiresAt *time.Time // nil when the invite never expires
+	MaxUses   int        // 0 for unlimited uses
+	Uses      int
+}
+
+// IsUsable reports whether the invite can still be redeemed.
+func (i ChannelInvite) IsUsable() bool {
+	if i.ExpiresAt != nil && !time.Now().Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// CreateInvite creates an invite link for a channel. A zero validFor means the
+// invite never expires and a zero maxUses means it can be used any number of times.
+func CreateInvite(channelID, createdBy int, validFor time.Duration, maxUses int) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating invite token: %v", err)
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	var expiresAt *time.Time
+	if validFor > 0 {
+		t := time.Now().UTC().Add(validFor)
+		expiresAt = &t
+	}
+	var uses *int
+	if maxUses > 0 {
+		uses = &maxUses
+	}
+
+	_, err := db.Exec("INSERT INTO channel_invites (token, channel_id, created_by, expires_at, max_uses) VALUES (?, ?, ?, ?, ?)", token, channelID, createdBy, expiresAt, uses)
+	if err != nil {
+		log.Printf("Error creating invite: %v", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// inviteSelect is the SELECT clause shared by the invite queries, read with scanInvite.
+const inviteSelect = `
+        SELECT token, channel_id, DATE_FORMAT(expires_at, '%Y-%m-%d %H:%i:%s'), COALESCE(max_uses, 0), uses
+        FROM channel_invites`
+
+// scanInvite reads a single invite selected with inviteSelect.
+func scanInvite(rs rowScanner) (ChannelInvite, error) {
+	var invite ChannelInvite
+	var expiresAtStr sql.NullString
+	err := rs.Scan(&invite.Token, &invite.ChannelID, &expiresAtStr, &invite.MaxUses, &invite.Uses)
+	if err != nil {
+		return invite, err
+	}
+	if expiresAtStr.Valid {
+		t, err := time.Parse("2006-01-02 15:04:05", expiresAtStr.String)
+		if err != nil {
+			log.Printf("Time parse error: %v", err)
+			return invite, err
+		}
+		invite.ExpiresAt = &t
+	}
+	return invite, nil
+}
+
+// FetchInvite retrieves an invite by its token.
+// It returns sql.ErrNoRows if the invite does not exist.
+func FetchInvite(token string) (ChannelInvite, error) {
+	invite, err := scanInvite(db.QueryRow(inviteSelect+" WHERE token = ?", token))
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error retrieving invite: %v", err)
+	}
+	return invite, err
+}
+
+// FetchInvites retrieves the invites of a channel, newest first.
+func FetchInvites(channelID int) ([]ChannelInvite, error) {
+	rows, err := db.Query(inviteSelect+" WHERE channel_id = ? ORDER BY created_at DESC", channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []ChannelInvite
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RevokeInvite deletes an invite of a channel.
+func RevokeInvite(channelID int, token string) error {
+	_, err := db.Exec("DELETE FROM channel_invites WHERE channel_id = ? AND token = ?", channelID, token)
+	if err != nil {
+		log.Printf("Error revoking invite: %v", err)
+	}
+	return err
+}
+
+// RedeemInvite makes a user a member of the invite's channel. It reports false
+// if the invite has expired or run out of uses, or the user is banned from the
+// channel. Existing members do not use up the invite.
+func RedeemInvite(invite ChannelInvite, userID int) (bool, error) {
+	access, err := loadChannelAccess(userID, invite.ChannelID)
+	if err != nil || access.Banned {
+		return false, err
+	}
+	if access.Role != "" {
+		return true, nil
+	}
+
+	// Count the use in the same statement that checks the limits, so two users
+	// racing for the last use cannot both get in
+	res, err := db.Exec(`
+        UPDATE channel_invites SET uses = uses + 1
+        WHERE token = ?
+          AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())
+          AND (max_uses IS NULL OR uses < max_uses)
+    `, invite.Token)
+	if err != nil {
+		log.Printf("Error redeeming invite: %v", err)
+		return false, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+
+	return true, AddChannelMember(invite.ChannelID, userID, RoleMember)
+}
@@ -0,0 +1,160 @@
+// mentions.go
+//
+// This file handles @mentions. Mentions are resolved against the users table
+// when a jot is saved and stored in the mentions table; only resolved mentions
+// are rendered as profile links, so "@nobody" stays plain text. Mentioned
+// users receive a persisted, real-time notification.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// mentionPattern matches an @username that is not part of an email address or word.
+var mentionPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_@./])@([\p{L}\p{N}_]{1,64})`)
+
+// ExtractMentions returns the distinct usernames mentioned in text, in order of appearance.
+// Usernames are compared case-insensitively, matching the users table collation.
+func ExtractMentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		key := strings.ToLower(match[2])
+		if !seen[key] {
+			seen[key] = true
+			names = append(names, match[2])
+		}
+	}
+	return names
+}
+
+// SyncMentions brings the stored mentions of a jot in line with its text.
+// Mentions of users that exist are added, mentions no longer in the text are
+// removed, and only newly mentioned users are notified, so calling it again
+// after an edit never notifies the same user twice.
+func SyncMentions(jotID int64, authorID int, text string) error {
+	// Resolve the mentioned usernames to user IDs, skipping unknown users
+	wanted := make(map[int]bool)
+	for _, name := range ExtractMentions(text) {
+		var userID int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ?", name).Scan(&userID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("Error resolving mention: %v", err)
+			return err
+		}
+		wanted[userID] = true
+	}
+
+	// Load the mentions stored for the jot so far
+	rows, err := db.Query("SELECT user_id FROM mentions WHERE content_id = ?", jotID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	existing := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			log.Printf("Scan error: %v", err)
+			return err
+		}
+		existing[userID] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+
+	// Drop mentions that were edited out
+	for userID := range existing {
+		if wanted[userID] {
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM mentions WHERE content_id = ? AND user_id = ?", jotID, userID); err != nil {
+			log.Printf("Error removing mention: %v", err)
+			return err
+		}
+	}
+
+	// Store and announce the new ones
+	var authorName string
+	for userID := range wanted {
+		if existing[userID] {
+			continue
+		}
+		if _, err := db.Exec("INSERT IGNORE INTO mentions (content_id, user_id) VALUES (?, ?)", jotID, userID); err != nil {
+			log.Printf("Error saving mention: %v", err)
+			return err
+		}
+
+		// Mentioning yourself is allowed but not worth a notification
+		if userID == authorID {
+			continue
+		}
+		if authorName == "" {
+			if authorName, err = GetUsernameByID(authorID); err != nil {
+				return err
+			}
+		}
+		message := fmt.Sprintf("%s mentioned you in a jot", authorName)
+		if err := CreateNotification(userID, authorID, "mention", int(jotID), message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AttachMentions fills in the Mentions of every jot with the usernames that
+// were resolved when it was saved. It issues a single query for all jots.
+func AttachMentions(jots []*Jot) error {
+	if len(jots) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(jots))
+	for i, jot := range jots {
+		ids[i] = jot.ID
+	}
+	placeholders, args := inClause(ids)
+	rows, err := db.Query(`
+        SELECT mentions.content_id, users.username
+        FROM mentions
+        JOIN users ON users.id = mentions.user_id
+        WHERE mentions.content_id IN (`+placeholders+`)
+    `, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	byJot := make(map[int][]string)
+	for rows.Next() {
+		var jotID int
+		var username string
+		if err := rows.Scan(&jotID, &username); err != nil {
+			log.Printf("Scan error: %v", err)
+			return err
+		}
+		byJot[jotID] = append(byJot[jotID], username)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+
+	for _, jot := range jots {
+		jot.Mentions = byJot[jot.ID]
+	}
+	return nil
+}
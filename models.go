@@ -12,23 +12,151 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
-	// Import the WebSocket package
 )
 
 // Jot represents a single jot's details, including the text content,
 // the username of the creator, and the creation timestamp.
 type Jot struct {
-	Text      string    // Text content of the jot
-	Username  string    // Username of the user who posted it
-	CreatedAt time.Time // Timestamp of when the jot was created
+	ID          int          // Unique identifier for the jot
+	Text        string       // Text content of the jot
+	Rendered    string       // HTML of the text cached when it was saved, empty when missing or out of date
+	Username    string       // Username of the user who posted it
+	CreatedAt   time.Time    // Timestamp of when the jot was created
+	ParentID    *int         // ID of the jot this one replies to, or nil for top-level jots
+	RootID      *int         // ID of the top-level jot of the thread, or nil for top-level jots
+	ReplyCount  int          // Number of direct replies to the jot
+	OriginalID  *int         // ID of the shared jot for re-jots and quotes, or nil
+	Original    *Jot         // The shared jot, only populated by AttachOriginals; nil if it was deleted
+	ShareCount  int          // Number of re-jots and quotes of this jot
+	Replies     []Jot        // Nested replies, only populated when rendering a thread
+	Reactions   []Reaction   // Reaction counts, only populated by AttachReactions
+	Mentions    []string     // Usernames resolved from @mentions, only populated by AttachMentions
+	IsPinned    bool         // Whether the jot is pinned in its channel, only populated on channel pages
+	Attachments []Attachment // Attached images and files, only populated by AttachAttachments
+	Preview     *LinkPreview // Card for the first link in the text, only populated by AttachLinkPreviews
+	ExpiresAt   *time.Time   // When an ephemeral jot disappears (UTC), or nil for permanent jots
+	Poll        *Poll        // Poll carried by the jot, only populated by AttachPolls
+}
+
+// IsRejot reports whether the jot is a plain re-jot, i.e. a share without commentary.
+func (j Jot) IsRejot() bool {
+	return j.OriginalID != nil && j.Text == ""
+}
+
+// IsQuote reports whether the jot quotes another jot with added commentary.
+func (j Jot) IsQuote() bool {
+	return j.OriginalID != nil && j.Text != ""
+}
+
+// jotSelect is the shared SELECT clause used by every query that returns jots.
+// Callers append their own WHERE and ORDER BY clauses and read the rows with scanJot.
+// Expired ephemeral jots are filtered out in the join, so they vanish from every
+// page as soon as they expire, before the reaper gets to delete them.
+const jotSelect = `
+        SELECT content.id, content.text, users.username, DATE_FORMAT(content.created_at, '%Y-%m-%d %H:%i:%s'),
+               content.parent_id, content.root_id,
+               (SELECT COUNT(*) FROM content AS replies WHERE replies.parent_id = content.id) AS reply_count,
+               content.original_id,
+               (SELECT COUNT(*) FROM content AS shares WHERE shares.original_id = content.id) AS share_count,
+               COALESCE(content.rendered_html, ''), content.render_version,
+               DATE_FORMAT(content.expires_at, '%Y-%m-%d %H:%i:%s')
+        FROM content
+        JOIN users ON content.user_id = users.id
+            AND (content.expires_at IS NULL OR content.expires_at > UTC_TIMESTAMP())`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanJot reads a single jot selected with jotSelect.
+func scanJot(rs rowScanner) (Jot, error) {
+	var jot Jot
+	var createdAtStr string // Temporary variable to hold the string version of the timestamp
+	var parentID, rootID, originalID sql.NullInt64
+	var rendered string
+	var version int
+	var expiresAt sql.NullString
+	err := rs.Scan(&jot.ID, &jot.Text, &jot.Username, &createdAtStr, &parentID, &rootID, &jot.ReplyCount, &originalID, &jot.ShareCount, &rendered, &version, &expiresAt)
+	if err != nil {
+		return jot, err
+	}
+
+	// Renderings cached by an older version of the renderer are redone on display
+	if version == renderVersion {
+		jot.Rendered = rendered
+	}
+
+	// Parse the string into a time.Time object
+	jot.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	if err != nil {
+		log.Printf("Time parse error: %v", err)
+		return jot, err
+	}
+
+	jot.ParentID = nullIntPtr(parentID)
+	jot.RootID = nullIntPtr(rootID)
+	jot.OriginalID = nullIntPtr(originalID)
+	if expiresAt.Valid {
+		if t, err := time.Parse("2006-01-02 15:04:05", expiresAt.String); err == nil {
+			jot.ExpiresAt = &t
+		}
+	}
+	return jot, nil
+}
+
+// scanJots reads every remaining row selected with jotSelect.
+func scanJots(rows *sql.Rows) ([]Jot, error) {
+	var jots []Jot
+	for rows.Next() {
+		jot, err := scanJot(rows)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		jots = append(jots, jot)
+	}
+
+	// Check for errors encountered during iteration over rows
+	if err := rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+
+	return jots, nil
+}
+
+// inClause returns the placeholders and arguments for an SQL "IN (...)" list of ids.
+func inClause(ids []int) (string, []any) {
+	placeholders := make([]string, len(ids))
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// nullIntPtr converts a nullable column into an *int, returning nil for NULL.
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
 }
 
 // User represents a user's details, including their ID, username, and password.
 type User struct {
-	ID       int    // Unique identifier for the user
-	Username string // Username chosen by the user
-	Password string // User's password (stored as plain text in this example)
+	ID          int       // Unique identifier for the user
+	Username    string    // Username chosen by the user
+	Password    string    // User's password (stored as plain text in this example)
+	DisplayName string    // Optional name shown on the profile instead of the username
+	Bio         string    // Optional short text about the user
+	AvatarKey   string    // Blob key prefix of the uploaded avatar, empty for the identicon
+	CreatedAt   time.Time // When the user signed up
 }
 
 // AuthenticateUser checks if the provided username exists in the database,
@@ -82,11 +210,103 @@ func CreateUser(username, password string) error {
 	return err
 }
 
+// AttachJotDetails loads everything a timeline card shows beyond the jot row
+// itself: the shared originals, the resolved mentions, attachments and link
+// previews of both, and the polls and reaction counts for userID.
+func AttachJotDetails(jots []Jot, userID int) error {
+	if err := AttachOriginals(jots, userID); err != nil {
+		return err
+	}
+
+	var all []*Jot
+	for i := range jots {
+		all = append(all, &jots[i])
+		if jots[i].Original != nil {
+			all = append(all, jots[i].Original)
+		}
+	}
+	if err := AttachMentions(all); err != nil {
+		return err
+	}
+	if err := AttachAttachments(all); err != nil {
+		return err
+	}
+	if err := AttachLinkPreviews(all); err != nil {
+		return err
+	}
+
+	// Polls are only shown on the jots themselves, not on embedded originals
+	top := make([]*Jot, len(jots))
+	for i := range jots {
+		top[i] = &jots[i]
+	}
+	if err := AttachPolls(top, userID); err != nil {
+		return err
+	}
+
+	return AttachReactions(jots, userID)
+}
+
+// flattenThread returns pointers to a jot and every reply nested below it.
+func flattenThread(jot *Jot) []*Jot {
+	all := []*Jot{jot}
+	for i := range jot.Replies {
+		all = append(all, flattenThread(&jot.Replies[i])...)
+	}
+	return all
+}
+
 // SaveContentToDB saves a new jot (content) to the database for the given user ID.
+// When originalID is set the jot shares that jot: as a plain re-jot if content is
+// empty, or as a quote with content as the commentary.
+// The jot passes through the processor chain (see processors.go), which may reject it:
+// with a *ValidationError for invalid text, or a *PostingError when the channel's
+// posting policy does not allow it.
+// attachments are the jot's files, already stored by PrepareAttachments.
+// A lifetime above zero makes the jot ephemeral: it disappears once the lifetime has passed.
+// poll, if set, is stored with the jot (see polls.go).
 // It logs an error message if the operation fails and also publishes a notification to Redis.
-func SaveContentToDB(content string, userID int, channelID *int) error {
-	// Insert the new jot into the content table
-	res, err := db.Exec("INSERT INTO content (text, user_id, channel_id) VALUES (?, ?, ?)", content, userID, channelID)
+// An error means the jot was not saved: once it is committed, failures to index it or
+// publish the notification are only logged, so callers may delete the attachment files
+// whenever an error is returned.
+func SaveContentToDB(content string, userID int, channelID *int, originalID *int, attachments []Attachment, lifetime time.Duration, poll *PollInput) error {
+	jot := &PendingJot{Text: content, UserID: userID, ChannelID: channelID, OriginalID: originalID, Attachments: attachments, Poll: poll}
+	return saveJot(jot, lifetime)
+}
+
+// saveJot runs a new top-level jot through the processor chain and stores it,
+// as described for SaveContentToDB. When jot.ScheduledID is set the scheduled
+// jot is removed in the same transaction; saveJot returns sql.ErrNoRows if it
+// is already gone.
+func saveJot(jot *PendingJot, lifetime time.Duration) error {
+	if err := runBeforeHooks(jot); err != nil {
+		return err
+	}
+
+	// Re-jotting a plain re-jot shares the jot it points at instead
+	if jot.OriginalID != nil {
+		id, err := resolveShareTarget(*jot.OriginalID)
+		if err != nil {
+			return err
+		}
+		jot.OriginalID = &id
+	}
+
+	// Insert the new jot into the content table, together with its
+	// attachments and poll, so a jot is kept whole or not at all. A scheduled
+	// jot leaves the queue in the same transaction, so it is posted only once
+	var expiresAt any
+	if lifetime > 0 {
+		expiresAt = time.Now().UTC().Add(lifetime).Format("2006-01-02 15:04:05")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO content (text, user_id, channel_id, original_id, expires_at) VALUES (?, ?, ?, ?, ?)", jot.Text, jot.UserID, jot.ChannelID, jot.OriginalID, expiresAt)
 	if err != nil {
 		log.Printf("Error saving content: %v", err)
 		return err
@@ -99,135 +319,343 @@ func SaveContentToDB(content string, userID int, channelID *int) error {
 		return err
 	}
 
-	// Publish the new jot notification to Redis
-	jotDetails := fmt.Sprintf("New jot posted: %d by user %d in channel %d", jotID, userID, channelID)
-	err = redisClient.Publish(ctx, newJotsChannel, jotDetails).Err()
+	if err := saveAttachments(tx, jotID, jot.UserID, jot.Attachments); err != nil {
+		return err
+	}
+	if err := savePoll(tx, jotID, jot.Poll); err != nil {
+		return err
+	}
+	if err := removeScheduledJot(tx, jot.ScheduledID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing jot: %v", err)
+		return err
+	}
+
+	// Index the jot's tags, mentions and so on
+	runAfterHooks(jot, jotID)
+
+	// Publish the new jot notification to Redis. The jot is saved either way,
+	// so a failure is only logged by publishHubMessage.
+	message := hubMessage{Message: fmt.Sprintf("New jot posted: %d by user %d", jotID, jot.UserID)}
+	if jot.ChannelID != nil {
+		message.ChannelID = *jot.ChannelID
+		message.Message += fmt.Sprintf(" in channel %d", *jot.ChannelID)
+	}
+	publishHubMessage(newJotsChannel, message)
+	return nil
+}
+
+// resolveShareTarget returns the jot a share of jotID should point at: the jot
+// itself, or the original when jotID is a plain re-jot.
+// It returns sql.ErrNoRows if the jot does not exist.
+func resolveShareTarget(jotID int) (int, error) {
+	var text string
+	var originalID sql.NullInt64
+	err := db.QueryRow("SELECT text, original_id FROM content WHERE id = ?", jotID).Scan(&text, &originalID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving shared jot: %v", err)
+		}
+		return 0, err
+	}
+	if text == "" && originalID.Valid {
+		return int(originalID.Int64), nil
+	}
+	return jotID, nil
+}
+
+// AttachOriginals fills in Original for every re-jot and quote in jots with a
+// single query. Shares whose original has been deleted, or is in a channel
+// userID cannot read, keep a nil Original.
+func AttachOriginals(jots []Jot, userID int) error {
+	var ids []int
+	for _, jot := range jots {
+		if jot.OriginalID != nil {
+			ids = append(ids, *jot.OriginalID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	placeholders, args := inClause(ids)
+	args = append(args, userID, userID)
+	rows, err := db.Query(jotSelect+" WHERE content.id IN ("+placeholders+") AND "+visibleJotsClause, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	originals, err := scanJots(rows)
 	if err != nil {
-		log.Printf("Error publishing to Redis: %v", err)
 		return err
 	}
 
+	byID := make(map[int]Jot, len(originals))
+	for _, original := range originals {
+		byID[original.ID] = original
+	}
+	for i := range jots {
+		if jots[i].OriginalID == nil {
+			continue
+		}
+		if original, ok := byID[*jots[i].OriginalID]; ok {
+			jots[i].Original = &original
+		}
+	}
 	return nil
 }
 
-// FetchAllJots retrieves all jots from the database, ordered by their creation date (most recent first).
+// FetchAllJots retrieves all top-level jots the user may read, ordered by their creation date (most recent first).
+// Replies are left out of the timeline and shown on the jot's permalink page instead.
 // It returns a slice of Jot structs or an error if the operation fails.
-func FetchAllJots() ([]Jot, error) {
+func FetchAllJots(userID int) ([]Jot, error) {
 	// Query to select all jots, joining with the users table to get the username
-	rows, err := db.Query("SELECT content.text, users.username, DATE_FORMAT(content.created_at, '%Y-%m-%d %H:%i:%s') FROM content JOIN users ON content.user_id = users.id ORDER BY content.created_at DESC")
+	rows, err := db.Query(jotSelect+" WHERE content.parent_id IS NULL AND "+visibleJotsClause+" ORDER BY content.created_at DESC", userID, userID)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	var jots []Jot
-	for rows.Next() {
-		var jot Jot
-		var createdAtStr string // Temporary variable to hold the string version of the timestamp
-		err := rows.Scan(&jot.Text, &jot.Username, &createdAtStr)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			return nil, err
-		}
+	return scanJots(rows)
+}
 
-		// Parse the string into a time.Time object
-		jot.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
-		if err != nil {
-			log.Printf("Time parse error: %v", err)
-			return nil, err
-		}
+// FetchJotByID retrieves a single jot by its ID.
+// It returns sql.ErrNoRows if the jot does not exist.
+func FetchJotByID(jotID int) (Jot, error) {
+	jot, err := scanJot(db.QueryRow(jotSelect+" WHERE content.id = ?", jotID))
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error retrieving jot: %v", err)
+	}
+	return jot, err
+}
 
-		jots = append(jots, jot)
+// FetchThread retrieves a jot together with all of its descendants, nested
+// under Replies in chronological order.
+func FetchThread(jotID int) (Jot, error) {
+	jot, err := FetchJotByID(jotID)
+	if err != nil {
+		return jot, err
 	}
 
-	// Check for errors encountered during iteration over rows
-	if err = rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
-		return nil, err
+	// Every reply in a thread shares the root's ID, so one query loads the whole thread
+	rootID := jot.ID
+	if jot.RootID != nil {
+		rootID = *jot.RootID
+	}
+	rows, err := db.Query(jotSelect+" WHERE content.root_id = ? ORDER BY content.created_at ASC, content.id ASC", rootID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return jot, err
 	}
+	defer rows.Close()
 
-	return jots, nil
+	replies, err := scanJots(rows)
+	if err != nil {
+		return jot, err
+	}
+
+	// Group replies by parent and attach them recursively below the requested jot
+	children := make(map[int][]Jot)
+	for _, reply := range replies {
+		children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+	}
+	jot.Replies = buildReplyTree(jot.ID, children)
+	return jot, nil
 }
 
-// Channel struct to hold a single channel's details
-type Channel struct {
-	ID            int
-	Name          string
-	IsFollowing   bool
-	FollowerCount int // Add this if it doesn't exist
+// buildReplyTree returns the replies to parentID with their own replies attached.
+func buildReplyTree(parentID int, children map[int][]Jot) []Jot {
+	replies := children[parentID]
+	for i := range replies {
+		replies[i].Replies = buildReplyTree(replies[i].ID, children)
+	}
+	return replies
 }
 
-// Fetch all channels from the database
-func FetchAllChannels(userID int) ([]Channel, error) {
-	rows, err := db.Query(`
-        SELECT c.id, c.name, 
-               COUNT(uf1.user_id) as follower_count,
-               CASE WHEN uf2.user_id IS NOT NULL THEN TRUE ELSE FALSE END AS is_following
-        FROM channels c
-        LEFT JOIN user_follows uf1 ON c.id = uf1.channel_id
-        LEFT JOIN user_follows uf2 ON c.id = uf2.channel_id AND uf2.user_id = ?
-        GROUP BY c.id, c.name, is_following
-    `, userID)
+// SaveReply saves a reply to an existing jot. The reply inherits the parent's
+// channel and thread root, and the parent's author is notified. Like a jot,
+// it passes through the processor chain, which may reject it.
+func SaveReply(content string, userID, parentID int) error {
+	var rootID, channelID sql.NullInt64
+	var parentAuthorID int
+	err := db.QueryRow("SELECT root_id, channel_id, user_id FROM content WHERE id = ?", parentID).Scan(&rootID, &channelID, &parentAuthorID)
 	if err != nil {
-		log.Printf("Query error: %v", err)
-		return nil, err
+		log.Printf("Error retrieving parent jot: %v", err)
+		return err
 	}
-	defer rows.Close()
 
-	var channels []Channel
-	for rows.Next() {
-		var channel Channel
-		err := rows.Scan(&channel.ID, &channel.Name, &channel.FollowerCount, &channel.IsFollowing)
+	// The reply is posted in its parent's channel, and follows its posting policy
+	jot := &PendingJot{Text: content, UserID: userID, ParentID: &parentID}
+	if channelID.Valid {
+		id := int(channelID.Int64)
+		jot.ChannelID = &id
+	}
+	if err := runBeforeHooks(jot); err != nil {
+		return err
+	}
+
+	// A reply to a top-level jot starts a thread rooted at that jot
+	root := int64(parentID)
+	if rootID.Valid {
+		root = rootID.Int64
+	}
+
+	res, err := db.Exec("INSERT INTO content (text, user_id, channel_id, parent_id, root_id) VALUES (?, ?, ?, ?, ?)", jot.Text, userID, channelID, parentID, root)
+	if err != nil {
+		log.Printf("Error saving reply: %v", err)
+		return err
+	}
+
+	jotID, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting last insert ID: %v", err)
+		return err
+	}
+
+	// Index the reply's hashtags and mentions
+	runAfterHooks(jot, jotID)
+
+	// Let the parent's author know, unless they replied to themselves
+	if parentAuthorID != userID {
+		username, err := GetUsernameByID(userID)
 		if err != nil {
-			log.Printf("Scan error: %v", err)
-			return nil, err
+			return err
+		}
+		message := fmt.Sprintf("%s replied to your jot", username)
+		if err := CreateNotification(parentAuthorID, userID, "reply", int(jotID), message); err != nil {
+			return err
 		}
-		channels = append(channels, channel)
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
-		return nil, err
+	return nil
+}
+
+// Channel struct to hold a single channel's details
+type Channel struct {
+	ID            int
+	Name          string
+	Slug          string // Unique URL name used in /channels/{slug}
+	Description   string
+	Icon          string // Optional emoji shown next to the name
+	Category      string // Key of one of channelCategories, empty if none
+	OwnerID       int    // User who created the channel, or 0 for channels created by hand
+	Visibility    string // One of the Visibility* constants
+	PostingPolicy string // One of the Posting* constants
+	SlowMode      int    // Seconds between jots per user in slow mode
+	IsFollowing   bool
+	Role          string // The current user's role in the channel, empty if not a member
+	IsMember      bool   // Whether the current user is a member of the channel
+	IsBanned      bool   // Whether the current user is banned from the channel
+	HasRequested  bool   // Whether the current user has a pending request to join
+	FollowerCount int    // Denormalized in channels.follower_count, kept up to date by ToggleFollowChannel
+	RecentJots    int    // Jots posted in the last 7 days, only populated by SearchChannels
+}
+
+// IsPublic reports whether every logged in user can read the channel.
+func (c Channel) IsPublic() bool {
+	return c.Visibility == VisibilityPublic
+}
+
+// CanRead reports whether the current user can read the channel's jots.
+func (c Channel) CanRead() bool {
+	return !c.IsBanned && (c.IsPublic() || c.IsMember)
+}
+
+// CanPost reports whether the current user can post in the channel under its
+// posting policy. Slow mode is only checked when a jot is saved.
+func (c Channel) CanPost() bool {
+	if c.PostingPolicy == PostingModerators {
+		return c.CanModerate()
 	}
+	return c.CanRead()
+}
 
-	return channels, nil
+// CanModerate reports whether the current user can moderate the channel.
+func (c Channel) CanModerate() bool {
+	return !c.IsBanned && (c.Role == RoleOwner || c.Role == RoleModerator)
 }
 
-// Save a user's channel follow/unfollow action
+// Fetch all channels from the database that the user can see, ordered by name.
+// Invite-only channels are only listed for their members.
+func FetchAllChannels(userID int) ([]Channel, error) {
+	return SearchChannels(userID, ChannelQuery{})
+}
+
+// Save a user's channel follow/unfollow action. The channel's denormalized
+// follower_count is updated in the same transaction, with the channel row
+// locked so concurrent follows can't miscount.
 func ToggleFollowChannel(userID, channelID int, follow bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT id FROM channels WHERE id = ? FOR UPDATE", channelID); err != nil {
+		log.Printf("Error locking channel: %v", err)
+		return err
+	}
+
+	var delta int64
 	if follow {
 		// Check if the user is already following the channel
 		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_follows WHERE user_id = ? AND channel_id = ?)", userID, channelID).Scan(&exists)
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM user_follows WHERE user_id = ? AND channel_id = ?)", userID, channelID).Scan(&exists)
 		if err != nil {
 			log.Printf("Error checking follow status: %v", err)
 			return err
 		}
 
 		// If the user is not already following, insert the follow record
-		if !exists {
-			_, err := db.Exec("INSERT INTO user_follows (user_id, channel_id) VALUES (?, ?)", userID, channelID)
-			if err != nil {
-				log.Printf("Error following channel: %v", err)
-				return err
-			}
-			//log.Println("User followed the channel successfully.")
-		} else {
-			log.Println("User is already following the channel.")
+		if exists {
+			return nil
+		}
+		_, err = tx.Exec("INSERT INTO user_follows (user_id, channel_id) VALUES (?, ?)", userID, channelID)
+		if err != nil {
+			log.Printf("Error following channel: %v", err)
+			return err
 		}
+		delta = 1
 	} else {
 		// Unfollow the channel
-		_, err := db.Exec("DELETE FROM user_follows WHERE user_id = ? AND channel_id = ?", userID, channelID)
+		res, err := tx.Exec("DELETE FROM user_follows WHERE user_id = ? AND channel_id = ?", userID, channelID)
 		if err != nil {
 			log.Printf("Error unfollowing channel: %v", err)
 			return err
 		}
-		//log.Println("User unfollowed the channel successfully.")
+		affected, err := res.RowsAffected()
+		if err != nil || affected == 0 {
+			return err
+		}
+		delta = -affected
+	}
+
+	if err = adjustFollowerCount(tx, channelID, delta); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing follow: %v", err)
+		return err
 	}
 	return nil
 }
 
+// adjustFollowerCount adds delta to a channel's denormalized follower count.
+// It must run in the transaction that changed user_follows.
+func adjustFollowerCount(tx *sql.Tx, channelID int, delta int64) error {
+	_, err := tx.Exec("UPDATE channels SET follower_count = GREATEST(CAST(follower_count AS SIGNED) + ?, 0) WHERE id = ?", delta, channelID)
+	if err != nil {
+		log.Printf("Error updating follower count: %v", err)
+	}
+	return err
+}
+
 // Check if a user is following a specific channel
 func IsUserFollowingChannel(userID, channelID int) (bool, error) {
 	var exists bool
@@ -244,13 +672,10 @@ func IsUserFollowingChannel(userID, channelID int) (bool, error) {
 	return exists, nil
 }
 
-// FetchJotsByChannel retrieves jots for a specific channel from the database
+// FetchJotsByChannel retrieves top-level jots for a specific channel from the database
 func FetchJotsByChannel(channelID int) ([]Jot, error) {
-	rows, err := db.Query(`
-        SELECT content.text, users.username, DATE_FORMAT(content.created_at, '%Y-%m-%d %H:%i:%s') 
-        FROM content 
-        JOIN users ON content.user_id = users.id 
-        WHERE content.channel_id = ?
+	rows, err := db.Query(jotSelect+`
+        WHERE content.channel_id = ? AND content.parent_id IS NULL
         ORDER BY content.created_at DESC
     `, channelID)
 	if err != nil {
@@ -259,31 +684,7 @@ func FetchJotsByChannel(channelID int) ([]Jot, error) {
 	}
 	defer rows.Close()
 
-	var jots []Jot
-	for rows.Next() {
-		var jot Jot
-		var createdAtStr string
-		err := rows.Scan(&jot.Text, &jot.Username, &createdAtStr)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			return nil, err
-		}
-
-		jot.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
-		if err != nil {
-			log.Printf("Time parse error: %v", err)
-			return nil, err
-		}
-
-		jots = append(jots, jot)
-	}
-
-	if err = rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
-		return nil, err
-	}
-
-	return jots, nil
+	return scanJots(rows)
 }
 
 // GetChannelNameByID retrieves the name of the channel by its ID
@@ -296,3 +697,51 @@ func GetChannelNameByID(channelID int) (string, error) {
 	}
 	return channelName, nil
 }
+
+// GetUsernameByID retrieves the username of the user with the given ID
+func GetUsernameByID(userID int) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err != nil {
+		log.Printf("Error retrieving username: %v", err)
+		return "", err
+	}
+	return username, nil
+}
+
+// GetUserIDByUsername retrieves a user's ID by their username.
+// It returns sql.ErrNoRows if there is no such user.
+func GetUserIDByUsername(username string) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error retrieving user ID: %v", err)
+	}
+	return userID, err
+}
+
+// FetchJotsByUser retrieves one page of a user's jots that viewerID may read, most recent first.
+// It fetches one extra row to report whether another page follows.
+func FetchJotsByUser(username string, viewerID, limit, offset int) ([]Jot, bool, error) {
+	rows, err := db.Query(jotSelect+`
+        WHERE users.username = ? AND `+visibleJotsClause+`
+        ORDER BY content.created_at DESC, content.id DESC
+        LIMIT ? OFFSET ?
+    `, username, viewerID, viewerID, limit+1, offset)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	jots, err := scanJots(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(jots) > limit
+	if hasMore {
+		jots = jots[:limit]
+	}
+	return jots, hasMore, nil
+}
@@ -0,0 +1,103 @@
+// notifications.go
+//
+// This file handles user notifications. Notifications are persisted in the
+// notifications table so they can be listed later, and are also published to
+// Redis so that any server instance holding a WebSocket for the recipient can
+// deliver them in real time.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Define the Redis channel for per-user notifications
+const notificationsChannel = "notifications_channel"
+
+// Notification represents a single notification shown to a user.
+type Notification struct {
+	ID        int       // Unique identifier for the notification
+	Kind      string    // Type of event, e.g. "reply"
+	JotID     *int      // Jot the notification refers to, if any
+	Message   string    // Human readable notification text
+	IsRead    bool      // Whether the user has already seen the notification
+	CreatedAt time.Time // Timestamp of when the notification was created
+}
+
+// CreateNotification stores a notification for userID, triggered by actorID,
+// and publishes it to Redis for real-time delivery. jotID may be 0 for
+// notifications that are not about a jot. Notifications about jots the
+// recipient is not allowed to read are dropped.
+func CreateNotification(userID, actorID int, kind string, jotID int, message string) error {
+	var jot any
+	if jotID != 0 {
+		canView, err := CanViewJot(userID, jotID)
+		if err != nil || !canView {
+			return err
+		}
+		jot = jotID
+	}
+
+	_, err := db.Exec("INSERT INTO notifications (user_id, actor_id, kind, jot_id, message) VALUES (?, ?, ?, ?, ?)", userID, actorID, kind, jot, message)
+	if err != nil {
+		log.Printf("Error saving notification: %v", err)
+		return err
+	}
+
+	return publishHubMessage(notificationsChannel, hubMessage{UserID: userID, Message: message})
+}
+
+// FetchNotifications retrieves the most recent notifications for a user, newest first.
+func FetchNotifications(userID int) ([]Notification, error) {
+	rows, err := db.Query(`
+        SELECT id, kind, jot_id, message, is_read, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+        FROM notifications
+        WHERE user_id = ?
+        ORDER BY created_at DESC, id DESC
+        LIMIT 100
+    `, userID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var createdAtStr string
+		var jotID sql.NullInt64
+		err := rows.Scan(&n.ID, &n.Kind, &jotID, &n.Message, &n.IsRead, &createdAtStr)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+
+		n.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		if err != nil {
+			log.Printf("Time parse error: %v", err)
+			return nil, err
+		}
+
+		n.JotID = nullIntPtr(jotID)
+		notifications = append(notifications, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// MarkNotificationsRead marks every notification of a user as read.
+func MarkNotificationsRead(userID int) error {
+	_, err := db.Exec("UPDATE notifications SET is_read = TRUE WHERE user_id = ? AND is_read = FALSE", userID)
+	if err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+	}
+	return err
+}
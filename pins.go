@@ -0,0 +1,198 @@
+// pins.go
+//
+// This file handles pinned jots. Channel moderators can pin up to
+// maxPinnedJots top-level jots, which are shown above the channel's
+// chronological list in the order the moderators choose. Every change is
+// recorded in the channel's audit log and pushed to connected clients as a
+// pins.updated event.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+)
+
+// maxPinnedJots is the most jots a channel can have pinned at once.
+const maxPinnedJots = 5
+
+// PinJot pins a top-level jot of a channel after the existing pins. It reports
+// false if the channel already has maxPinnedJots pins. Pinning a pinned jot is
+// a no-op.
+func PinJot(channelID, jotID, actorID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Lock the channel so concurrent pins can't exceed the limit
+	var count, lastPosition int
+	if _, err = tx.Exec("SELECT id FROM channels WHERE id = ? FOR UPDATE", channelID); err != nil {
+		log.Printf("Error locking channel: %v", err)
+		return false, err
+	}
+	err = tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(position), 0) FROM channel_pins WHERE channel_id = ?", channelID).Scan(&count, &lastPosition)
+	if err != nil {
+		log.Printf("Error counting pins: %v", err)
+		return false, err
+	}
+	if count >= maxPinnedJots {
+		return false, nil
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO channel_pins (channel_id, content_id, position, pinned_by) VALUES (?, ?, ?, ?)", channelID, jotID, lastPosition+1, actorID)
+	if err != nil {
+		log.Printf("Error pinning jot: %v", err)
+		return false, err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return true, nil
+	}
+	if err = writeAuditLog(tx, channelID, actorID, nil, AuditJotPinned, strconv.Itoa(jotID)); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing pin: %v", err)
+		return false, err
+	}
+	return true, publishPins(channelID, jotID)
+}
+
+// UnpinJot removes a jot from its channel's pins.
+func UnpinJot(channelID, jotID, actorID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM channel_pins WHERE channel_id = ? AND content_id = ?", channelID, jotID)
+	if err != nil {
+		log.Printf("Error unpinning jot: %v", err)
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+	if err = writeAuditLog(tx, channelID, actorID, nil, AuditJotUnpinned, strconv.Itoa(jotID)); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing unpin: %v", err)
+		return err
+	}
+	return publishPins(channelID, jotID)
+}
+
+// MovePin moves a pinned jot one place up (towards the top) or down by
+// swapping positions with its neighbour. Moving past either end is a no-op.
+func MovePin(channelID, jotID int, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var position int
+	err = tx.QueryRow("SELECT position FROM channel_pins WHERE channel_id = ? AND content_id = ? FOR UPDATE", channelID, jotID).Scan(&position)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Printf("Error retrieving pin: %v", err)
+		return err
+	}
+
+	query := "SELECT content_id, position FROM channel_pins WHERE channel_id = ? AND position > ? ORDER BY position ASC LIMIT 1 FOR UPDATE"
+	if up {
+		query = "SELECT content_id, position FROM channel_pins WHERE channel_id = ? AND position < ? ORDER BY position DESC LIMIT 1 FOR UPDATE"
+	}
+	var neighbourID, neighbourPosition int
+	err = tx.QueryRow(query, channelID, position).Scan(&neighbourID, &neighbourPosition)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Printf("Error retrieving neighbouring pin: %v", err)
+		return err
+	}
+
+	for _, swap := range [][2]int{{jotID, neighbourPosition}, {neighbourID, position}} {
+		_, err = tx.Exec("UPDATE channel_pins SET position = ? WHERE channel_id = ? AND content_id = ?", swap[1], channelID, swap[0])
+		if err != nil {
+			log.Printf("Error reordering pins: %v", err)
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing pin order: %v", err)
+		return err
+	}
+	return publishPins(channelID, jotID)
+}
+
+// FetchPinnedJots retrieves a channel's pinned jots in pin order.
+func FetchPinnedJots(channelID int) ([]Jot, error) {
+	rows, err := db.Query(jotSelect+`
+        JOIN channel_pins ON channel_pins.content_id = content.id
+        WHERE channel_pins.channel_id = ?
+        ORDER BY channel_pins.position
+    `, channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	jots, err := scanJots(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jots {
+		jots[i].IsPinned = true
+	}
+	return jots, nil
+}
+
+// fetchPinnedIDs retrieves the IDs of a channel's pinned jots in pin order.
+func fetchPinnedIDs(channelID int) ([]int, error) {
+	rows, err := db.Query("SELECT content_id FROM channel_pins WHERE channel_id = ? ORDER BY position", channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// publishPins sends the channel's current pin order to its readers after
+// jotID was pinned, unpinned or moved.
+func publishPins(channelID, jotID int) error {
+	ids, err := fetchPinnedIDs(channelID)
+	if err != nil {
+		return err
+	}
+	return PublishEvent(Event{
+		Type:      EventPinsUpdated,
+		JotID:     jotID,
+		Data:      map[string]any{"channel_id": channelID, "pinned": ids},
+		ChannelID: channelID,
+	})
+}
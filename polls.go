@@ -0,0 +1,426 @@
+// polls.go
+//
+// This file handles polls attached to jots. A poll has 2 to 6 options, allows
+// one or several choices, and closes after a duration picked in the composer.
+// Each user votes once: poll_voters records who voted, and its primary key
+// stops a second vote even when two arrive at the same time, while
+// poll_votes holds the options they picked. Results are only shown to users
+// who voted, or once the poll has closed; new votes are pushed to open pages
+// as a poll.updated event with the new tally.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rivo/uniseg"
+)
+
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 6
+	maxPollOptionLength = 80 // In user-perceived characters
+)
+
+// PollDuration is one of the durations a poll can stay open for.
+type PollDuration struct {
+	Value    string // Form value
+	Label    string
+	Duration time.Duration
+}
+
+// pollDurations are the durations the composer offers, shortest first.
+var pollDurations = []PollDuration{
+	{"1h", "1 hour", time.Hour},
+	{"24h", "1 day", 24 * time.Hour},
+	{"72h", "3 days", 3 * 24 * time.Hour},
+	{"168h", "1 week", 7 * 24 * time.Hour},
+}
+
+// defaultPollDuration is the form value selected in a fresh composer.
+const defaultPollDuration = "24h"
+
+// ParsePollDuration returns the duration for a form value. ok is false for
+// unknown values.
+func ParsePollDuration(value string) (duration time.Duration, ok bool) {
+	for _, d := range pollDurations {
+		if d.Value == value {
+			return d.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// PollInput is a poll submitted with a new jot, before validation.
+type PollInput struct {
+	Options  []string // Option labels as entered; blank ones are dropped
+	Multiple bool     // Whether voters may pick several options
+	Duration time.Duration
+}
+
+// PollError reports a vote that cannot be counted, e.g. on a closed poll.
+// Its message is shown to the user.
+type PollError struct {
+	Message string
+}
+
+func (e *PollError) Error() string {
+	return e.Message
+}
+
+// Poll is a poll as shown on a jot, with the tally and the current user's votes.
+type Poll struct {
+	JotID    int
+	Options  []PollOption
+	Multiple bool
+	ClosesAt time.Time // In UTC
+	Voters   int       // Number of users who voted
+	Voted    bool      // Whether the current user voted
+}
+
+// PollOption is one of the choices of a poll.
+type PollOption struct {
+	ID      int
+	Label   string
+	Votes   int
+	Percent int  // Share of the voters who picked this option
+	Chosen  bool // Whether the current user picked this option
+}
+
+// Closed reports whether voting has ended.
+func (p Poll) Closed() bool {
+	return !time.Now().Before(p.ClosesAt)
+}
+
+// ShowResults reports whether the tally may be shown: to users who voted,
+// and to everyone once the poll has closed.
+func (p Poll) ShowResults() bool {
+	return p.Voted || p.Closed()
+}
+
+// ClosesIn returns how long the poll stays open, e.g. "5h 12m".
+func (p Poll) ClosesIn() string {
+	seconds := int(time.Until(p.ClosesAt).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return formatWait(seconds)
+}
+
+// percent returns votes as a whole percentage of voters.
+func percent(votes, voters int) int {
+	if voters == 0 {
+		return 0
+	}
+	return votes * 100 / voters
+}
+
+// validatePollOptions normalizes the option labels of a new poll, dropping
+// blank ones. Problems are reported as a *ValidationError for the "poll" field.
+func validatePollOptions(options []string) ([]string, error) {
+	var invalid ValidationError
+	var labels []string
+	seen := make(map[string]bool)
+	for _, option := range options {
+		label := strings.Join(strings.Fields(NormalizeText(option)), " ")
+		if label == "" {
+			continue
+		}
+		if uniseg.GraphemeClusterCount(label) > maxPollOptionLength {
+			invalid.add("poll", fmt.Sprintf("Poll options can be at most %d characters long", maxPollOptionLength))
+		}
+		key := strings.ToLower(label)
+		if seen[key] {
+			invalid.add("poll", "Poll options must be different from each other")
+		}
+		seen[key] = true
+		labels = append(labels, label)
+	}
+	if len(labels) < minPollOptions || len(labels) > maxPollOptions {
+		invalid.add("poll", fmt.Sprintf("A poll needs %d to %d options", minPollOptions, maxPollOptions))
+	}
+
+	if len(invalid.Fields) > 0 {
+		return nil, &invalid
+	}
+	return labels, nil
+}
+
+// pollProcessor validates the poll submitted with a jot. SaveContentToDB
+// stores it in the same transaction as the jot, so a jot is never left
+// without the poll it was posted with. Only top-level jots carry polls.
+type pollProcessor struct{}
+
+func (pollProcessor) Before(jot *PendingJot) error {
+	if jot.Poll == nil {
+		return nil
+	}
+	if jot.ParentID != nil || jot.OriginalID != nil {
+		return &ValidationError{Fields: map[string]string{"poll": "Replies and shares can't have polls"}}
+	}
+	labels, err := validatePollOptions(jot.Poll.Options)
+	if err != nil {
+		return err
+	}
+	jot.Poll.Options = labels
+	return nil
+}
+
+func (pollProcessor) After(*PendingJot, int64) error { return nil }
+
+// savePoll stores a validated poll for a jot being saved in tx. poll may be nil.
+func savePoll(tx *sql.Tx, jotID int64, poll *PollInput) error {
+	if poll == nil {
+		return nil
+	}
+	closesAt := time.Now().UTC().Add(poll.Duration).Format("2006-01-02 15:04:05")
+	if _, err := tx.Exec("INSERT INTO polls (content_id, multiple, closes_at) VALUES (?, ?, ?)", jotID, poll.Multiple, closesAt); err != nil {
+		log.Printf("Error saving poll: %v", err)
+		return err
+	}
+	for i, label := range poll.Options {
+		if _, err := tx.Exec("INSERT INTO poll_options (content_id, position, label) VALUES (?, ?, ?)", jotID, i, label); err != nil {
+			log.Printf("Error saving poll option: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Vote records a user's vote on the poll of a jot and publishes the new
+// tally: the vote counts to the users who voted, who may see the results,
+// and only the number of voters to everyone else. Single choice polls take
+// exactly one option. It returns sql.ErrNoRows if the jot has no poll, and a
+// *PollError if the poll has closed, the user already voted, or the options
+// are not the poll's.
+func Vote(jotID, userID int, optionIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var multiple, open bool
+	err = tx.QueryRow("SELECT multiple, closes_at > UTC_TIMESTAMP() FROM polls WHERE content_id = ?", jotID).Scan(&multiple, &open)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error fetching poll: %v", err)
+		}
+		return err
+	}
+	if !open {
+		return &PollError{Message: "This poll has closed"}
+	}
+
+	// Drop repeated options before checking the count
+	chosen := make(map[int]bool)
+	var ids []int
+	for _, id := range optionIDs {
+		if !chosen[id] {
+			chosen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return &PollError{Message: "Pick an option to vote for"}
+	}
+	if len(ids) > 1 && !multiple {
+		return &PollError{Message: "This poll only allows one choice"}
+	}
+	placeholders, args := inClause(ids)
+	var known int
+	err = tx.QueryRow("SELECT COUNT(*) FROM poll_options WHERE content_id = ? AND id IN ("+placeholders+")", append([]any{jotID}, args...)...).Scan(&known)
+	if err != nil {
+		log.Printf("Error checking poll options: %v", err)
+		return err
+	}
+	if known != len(ids) {
+		return &PollError{Message: "That option is not part of this poll"}
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO poll_voters (content_id, user_id) VALUES (?, ?)", jotID, userID)
+	if err != nil {
+		log.Printf("Error recording voter: %v", err)
+		return err
+	}
+	if requireAffected(res) != nil {
+		return &PollError{Message: "You have already voted in this poll"}
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("INSERT INTO poll_votes (option_id, user_id, content_id) VALUES (?, ?, ?)", id, userID, jotID); err != nil {
+			log.Printf("Error recording vote: %v", err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing vote: %v", err)
+		return err
+	}
+
+	tally, err := FetchPollTally(jotID)
+	if err != nil {
+		return err
+	}
+	channelID, err := jotChannelID(jotID)
+	if err != nil {
+		return err
+	}
+	err = PublishEvent(Event{Type: EventPollUpdated, JotID: jotID, ChannelID: channelID, PollVoters: jotID, Data: tally})
+	if err != nil {
+		return err
+	}
+	return PublishEvent(Event{Type: EventPollUpdated, JotID: jotID, ChannelID: channelID, PollNonVoters: jotID, Data: PollTally{Voters: tally.Voters}})
+}
+
+// PollTally is the vote count of a poll, as sent to WebSocket clients.
+// Votes is left out for users who may not see the results yet.
+type PollTally struct {
+	Voters int         `json:"voters"`
+	Votes  map[int]int `json:"votes,omitempty"` // Option ID -> number of votes
+}
+
+// fetchPollVoterIDs retrieves the set of users who voted in a jot's poll.
+func fetchPollVoterIDs(jotID int) (map[int]bool, error) {
+	rows, err := db.Query("SELECT user_id FROM poll_voters WHERE content_id = ?", jotID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	voters := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		voters[userID] = true
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return voters, nil
+}
+
+// FetchPollTally returns the current vote count of a jot's poll.
+func FetchPollTally(jotID int) (PollTally, error) {
+	tally := PollTally{Votes: make(map[int]int)}
+	err := db.QueryRow("SELECT COUNT(*) FROM poll_voters WHERE content_id = ?", jotID).Scan(&tally.Voters)
+	if err != nil {
+		log.Printf("Error counting poll voters: %v", err)
+		return tally, err
+	}
+
+	rows, err := db.Query(`
+        SELECT o.id, COUNT(v.user_id)
+        FROM poll_options o
+        LEFT JOIN poll_votes v ON v.option_id = o.id
+        WHERE o.content_id = ?
+        GROUP BY o.id
+    `, jotID)
+	if err != nil {
+		log.Printf("Error counting poll votes: %v", err)
+		return tally, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var optionID, votes int
+		if err := rows.Scan(&optionID, &votes); err != nil {
+			log.Printf("Scan error: %v", err)
+			return tally, err
+		}
+		tally.Votes[optionID] = votes
+	}
+	return tally, rows.Err()
+}
+
+// AttachPolls fills in the Poll of every jot that has one, with the tally
+// and the votes of userID. It issues two queries for all jots.
+func AttachPolls(jots []*Jot, userID int) error {
+	if len(jots) == 0 {
+		return nil
+	}
+	ids := make([]int, len(jots))
+	byID := make(map[int][]*Jot, len(jots))
+	for i, jot := range jots {
+		ids[i] = jot.ID
+		byID[jot.ID] = append(byID[jot.ID], jot)
+	}
+	placeholders, idArgs := inClause(ids)
+
+	rows, err := db.Query(`
+        SELECT p.content_id, p.multiple, DATE_FORMAT(p.closes_at, '%Y-%m-%d %H:%i:%s'),
+               (SELECT COUNT(*) FROM poll_voters v WHERE v.content_id = p.content_id),
+               EXISTS (SELECT 1 FROM poll_voters v WHERE v.content_id = p.content_id AND v.user_id = ?)
+        FROM polls p
+        WHERE p.content_id IN (`+placeholders+`)
+    `, append([]any{userID}, idArgs...)...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	polls := make(map[int]*Poll)
+	for rows.Next() {
+		poll := &Poll{}
+		var closesAt string
+		if err := rows.Scan(&poll.JotID, &poll.Multiple, &closesAt, &poll.Voters, &poll.Voted); err != nil {
+			log.Printf("Scan error: %v", err)
+			rows.Close()
+			return err
+		}
+		poll.ClosesAt, _ = time.Parse("2006-01-02 15:04:05", closesAt)
+		polls[poll.JotID] = poll
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+	if len(polls) == 0 {
+		return nil
+	}
+
+	rows, err = db.Query(`
+        SELECT o.content_id, o.id, o.label, COUNT(v.user_id), COALESCE(SUM(v.user_id = ?), 0) > 0
+        FROM poll_options o
+        LEFT JOIN poll_votes v ON v.option_id = o.id
+        WHERE o.content_id IN (`+placeholders+`)
+        GROUP BY o.id
+        ORDER BY o.content_id, o.position
+    `, append([]any{userID}, idArgs...)...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jotID int
+		var option PollOption
+		if err := rows.Scan(&jotID, &option.ID, &option.Label, &option.Votes, &option.Chosen); err != nil {
+			log.Printf("Scan error: %v", err)
+			return err
+		}
+		if poll := polls[jotID]; poll != nil {
+			option.Percent = percent(option.Votes, poll.Voters)
+			poll.Options = append(poll.Options, option)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+
+	for id, poll := range polls {
+		for _, jot := range byID[id] {
+			jot.Poll = poll
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// posting.go
+//
+// This file handles per-channel posting policies. A channel is either open to
+// everyone who can read it, limited to its moderators (an announcement
+// channel), or in slow mode, where each user has to wait a configurable
+// interval between jots. Owners and moderators are exempt from slow mode.
+// The policy is checked when a jot, share or reply is saved, so every way of
+// posting enforces it.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Posting policies, as stored in channels.posting_policy
+const (
+	PostingOpen       = "open"
+	PostingModerators = "moderators"
+	PostingSlowMode   = "slow"
+)
+
+// maxSlowModeSeconds is the longest slow mode interval a channel can have (6 hours).
+const maxSlowModeSeconds = 6 * 60 * 60
+
+// PostingError is returned when a channel's posting policy rejects a jot.
+// Its message is meant to be shown to the user in the composer.
+type PostingError struct {
+	Message string
+}
+
+func (e *PostingError) Error() string {
+	return e.Message
+}
+
+// IsValidPostingPolicy reports whether policy is one of the Posting* constants.
+func IsValidPostingPolicy(policy string) bool {
+	return policy == PostingOpen || policy == PostingModerators || policy == PostingSlowMode
+}
+
+// CheckPostingPolicy checks if a user may post in a channel right now. It
+// returns a *PostingError describing why not, or another error if the check
+// itself failed.
+func CheckPostingPolicy(userID, channelID int) error {
+	access, err := loadChannelAccess(userID, channelID)
+	if err == sql.ErrNoRows {
+		return &PostingError{"This channel no longer exists"}
+	} else if err != nil {
+		return err
+	}
+
+	if !permits(access, ActionPostJot) {
+		switch {
+		case access.Banned:
+			return &PostingError{"You are banned from this channel"}
+		case access.PostingPolicy == PostingModerators && permits(access, ActionReadChannel):
+			return &PostingError{"Only moderators can post in this channel"}
+		default:
+			return &PostingError{"You are not a member of this channel"}
+		}
+	}
+
+	if access.PostingPolicy != PostingSlowMode || permits(access, ActionRemoveJot) {
+		return nil
+	}
+
+	// Slow mode: count the time since the user's last jot or reply in the channel
+	var interval int
+	var elapsed sql.NullInt64
+	err = db.QueryRow(`
+        SELECT c.slow_mode_seconds,
+               (SELECT TIMESTAMPDIFF(SECOND, MAX(content.created_at), NOW()) FROM content
+                WHERE content.channel_id = c.id AND content.user_id = ?)
+        FROM channels c
+        WHERE c.id = ?
+    `, userID, channelID).Scan(&interval, &elapsed)
+	if err != nil {
+		log.Printf("Error checking slow mode: %v", err)
+		return err
+	}
+	if elapsed.Valid && int(elapsed.Int64) < interval {
+		return &PostingError{fmt.Sprintf("Slow mode is on: you can post in this channel again in %s", formatWait(interval-int(elapsed.Int64)))}
+	}
+	return nil
+}
+
+// formatWait describes a number of seconds for slow mode messages, e.g. "2m 5s".
+func formatWait(seconds int) string {
+	switch {
+	case seconds >= 3600:
+		return fmt.Sprintf("%dh %dm", seconds/3600, seconds%3600/60)
+	case seconds >= 60:
+		return fmt.Sprintf("%dm %ds", seconds/60, seconds%60)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// SetPostingPolicy changes a channel's posting policy and slow mode interval
+// and records the change in the audit log. The interval is only kept for
+// slow mode.
+func SetPostingPolicy(channelID, actorID int, policy string, slowModeSeconds int) error {
+	if policy != PostingSlowMode {
+		slowModeSeconds = 0
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE channels SET posting_policy = ?, slow_mode_seconds = ? WHERE id = ?", policy, slowModeSeconds, channelID)
+	if err != nil {
+		log.Printf("Error updating posting policy: %v", err)
+		return err
+	}
+
+	details := policy
+	if policy == PostingSlowMode {
+		details += fmt.Sprintf(" (%s)", formatWait(slowModeSeconds))
+	}
+	if err = writeAuditLog(tx, channelID, actorID, nil, AuditPostingChanged, details); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing posting policy: %v", err)
+		return err
+	}
+	return nil
+}
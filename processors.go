@@ -0,0 +1,217 @@
+// processors.go
+//
+// This file defines the chain of processors every new jot and reply passes
+// through when it is saved. Each processor is a small step with two hooks:
+// Before runs before the jot is stored and may reject it or rewrite its text,
+// and After runs once it is stored, to index or annotate it (tags, mentions,
+// the rendered text, link previews). After hooks can't undo the save, so
+// their failures are logged rather than returned. SaveContentToDB and
+// SaveReply only do the storing; everything else about posting is a
+// processor, so new behaviors are added here instead of growing those
+// functions.
+//
+// The chain is put together at startup from the environment; see
+// newJotProcessors.
+
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PendingJot is a jot on its way into the database.
+type PendingJot struct {
+	Text        string       // The text to store; Before hooks may rewrite it
+	UserID      int          // Author
+	ChannelID   *int         // Channel the jot is posted in, nil if none
+	OriginalID  *int         // Shared jot, for re-jots and quotes
+	ParentID    *int         // Jot replied to, for replies
+	Attachments []Attachment // Files already stored by PrepareAttachments
+	Poll        *PollInput   // Poll submitted with the jot, nil if none
+	ScheduledID int          // Scheduled jot being published, 0 if none
+}
+
+// JotProcessor is one step of saving a jot.
+type JotProcessor interface {
+	// Before runs, in chain order, before the jot is stored. Returning an
+	// error rejects the jot and stops the chain.
+	Before(jot *PendingJot) error
+	// After runs, in chain order, once the jot is stored under jotID. An
+	// error is logged and the rest of the chain still runs.
+	After(jot *PendingJot, jotID int64) error
+}
+
+// jotProcessors is the chain run for every new jot and reply.
+var jotProcessors = newJotProcessors()
+
+// newJotProcessors builds the processor chain. Validation comes first, so
+// later processors always see normalized text, and rendering comes after
+// the mentions it links are stored. A word filter is added when
+// BLOCKED_WORDS holds a comma separated list of words.
+func newJotProcessors() []JotProcessor {
+	processors := []JotProcessor{validationProcessor{}}
+	if words := os.Getenv("BLOCKED_WORDS"); words != "" {
+		processors = append(processors, NewWordFilter(strings.Split(words, ",")))
+	}
+	return append(processors,
+		postingPolicyProcessor{},
+		pollProcessor{},
+		tagProcessor{},
+		mentionProcessor{},
+		renderProcessor{},
+		linkPreviewProcessor{},
+	)
+}
+
+// runBeforeHooks runs the Before hook of every processor.
+func runBeforeHooks(jot *PendingJot) error {
+	for _, processor := range jotProcessors {
+		if err := processor.Before(jot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterHooks runs the After hook of every processor. The jot is already
+// saved, so a failing hook is logged and the others still run.
+func runAfterHooks(jot *PendingJot, jotID int64) {
+	for _, processor := range jotProcessors {
+		if err := processor.After(jot, jotID); err != nil {
+			log.Printf("Error processing jot %d with %T: %v", jotID, processor, err)
+		}
+	}
+}
+
+// validationProcessor normalizes and validates the text (see validation.go).
+// Only shares may leave it empty.
+type validationProcessor struct{}
+
+func (validationProcessor) Before(jot *PendingJot) error {
+	text, err := ValidateJotText(jot.Text, jot.OriginalID != nil)
+	if err != nil {
+		return err
+	}
+	jot.Text = text
+	return nil
+}
+
+func (validationProcessor) After(*PendingJot, int64) error { return nil }
+
+// postingPolicyProcessor enforces the posting policy of the jot's channel,
+// rejecting the jot with a *PostingError.
+type postingPolicyProcessor struct{}
+
+func (postingPolicyProcessor) Before(jot *PendingJot) error {
+	if jot.ChannelID == nil {
+		return nil
+	}
+	return CheckPostingPolicy(jot.UserID, *jot.ChannelID)
+}
+
+func (postingPolicyProcessor) After(*PendingJot, int64) error { return nil }
+
+// WordFilter masks blocked words in the text of new jots, replacing each
+// letter with an asterisk. Words match case-insensitively and only as whole
+// words, so blocking "ass" leaves "class" alone. Word boundaries are found
+// with Unicode letters, digits and marks, since the regexp \b only knows
+// ASCII and would treat the "ß" in "Straße" as a boundary.
+type WordFilter struct {
+	pattern *regexp.Regexp
+}
+
+// NewWordFilter creates a filter for words. Blank entries are ignored.
+func NewWordFilter(words []string) *WordFilter {
+	var quoted []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return &WordFilter{}
+	}
+	// Try longer words first, so a word isn't cut short by a blocked prefix
+	sort.SliceStable(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return &WordFilter{pattern: regexp.MustCompile(`(?i)(?:` + strings.Join(quoted, "|") + `)`)}
+}
+
+func (f *WordFilter) Before(jot *PendingJot) error {
+	if f.pattern == nil {
+		return nil
+	}
+	var masked strings.Builder
+	last := 0
+	for _, match := range f.pattern.FindAllStringIndex(jot.Text, -1) {
+		start, end := match[0], match[1]
+		if !isWholeWord(jot.Text, start, end) {
+			continue
+		}
+		masked.WriteString(jot.Text[last:start])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(jot.Text[start:end])))
+		last = end
+	}
+	masked.WriteString(jot.Text[last:])
+	jot.Text = masked.String()
+	return nil
+}
+
+func (f *WordFilter) After(*PendingJot, int64) error { return nil }
+
+// isWholeWord reports whether text[start:end] is not part of a longer word.
+func isWholeWord(text string, start, end int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:start])
+	after, _ := utf8.DecodeRuneInString(text[end:])
+	return (start == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after))
+}
+
+// isWordRune reports whether r can be part of a word.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.In(r, unicode.L, unicode.N, unicode.M)
+}
+
+// tagProcessor indexes the jot's hashtags.
+type tagProcessor struct{}
+
+func (tagProcessor) Before(*PendingJot) error { return nil }
+
+func (tagProcessor) After(jot *PendingJot, jotID int64) error {
+	return SaveTags(jotID, jot.Text)
+}
+
+// mentionProcessor stores the jot's mentions and notifies the mentioned users.
+type mentionProcessor struct{}
+
+func (mentionProcessor) Before(*PendingJot) error { return nil }
+
+func (mentionProcessor) After(jot *PendingJot, jotID int64) error {
+	return SyncMentions(jotID, jot.UserID, jot.Text)
+}
+
+// renderProcessor caches the jot's rendered text (see markdown.go).
+type renderProcessor struct{}
+
+func (renderProcessor) Before(*PendingJot) error { return nil }
+
+func (renderProcessor) After(jot *PendingJot, jotID int64) error {
+	return cacheRenderedText(jotID, jot.Text)
+}
+
+// linkPreviewProcessor queues a preview of the jot's first link. Replies are
+// skipped, as threads don't show previews.
+type linkPreviewProcessor struct{}
+
+func (linkPreviewProcessor) Before(*PendingJot) error { return nil }
+
+func (linkPreviewProcessor) After(jot *PendingJot, jotID int64) error {
+	if jot.ParentID == nil {
+		QueueLinkPreview(jotID, jot.ChannelID, jot.Text)
+	}
+	return nil
+}
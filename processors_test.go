@@ -0,0 +1,107 @@
+// processors_test.go
+//
+// This file tests the processors that check and rewrite a jot before it is
+// stored without touching the database.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWordFilter(t *testing.T) {
+	filter := NewWordFilter([]string{"ass", " darn ", "", "straße", "ключ"})
+	tests := []struct {
+		text, want string
+	}{
+		{"what a darn shame", "what a **** shame"},
+		{"DARN it, Darn.", "**** it, ****."},
+		{"a class act", "a class act"},
+		{"ass", "***"},
+		{"ass ass", "*** ***"},
+		{"assassin", "assassin"},
+		{"Die Straße ist gesperrt", "Die ****** ist gesperrt"},
+		{"Straßenbahn", "Straßenbahn"},
+		{"éass and assé and ass_", "éass and assé and ass_"},
+		{"ass\u0301 is not ass", "ass\u0301 is not ***"},
+		{"ключ, ключи", "****, ключи"},
+		{"darn_it darn-it", "darn_it ****-it"},
+	}
+	for _, tt := range tests {
+		jot := &PendingJot{Text: tt.text}
+		if err := filter.Before(jot); err != nil {
+			t.Fatalf("Before(%q) returned %v", tt.text, err)
+		}
+		if jot.Text != tt.want {
+			t.Errorf("Before(%q) = %q, want %q", tt.text, jot.Text, tt.want)
+		}
+	}
+}
+
+func TestWordFilterLongerWordsFirst(t *testing.T) {
+	filter := NewWordFilter([]string{"heck", "heckin"})
+	jot := &PendingJot{Text: "heckin heck"}
+	filter.Before(jot)
+	if want := "****** ****"; jot.Text != want {
+		t.Errorf("Before = %q, want %q", jot.Text, want)
+	}
+}
+
+func TestWordFilterWithoutWords(t *testing.T) {
+	filter := NewWordFilter([]string{" ", ""})
+	jot := &PendingJot{Text: "anything goes"}
+	filter.Before(jot)
+	if jot.Text != "anything goes" {
+		t.Errorf("Before = %q, want the text unchanged", jot.Text)
+	}
+}
+
+func TestValidationProcessor(t *testing.T) {
+	jot := &PendingJot{Text: "  Cafe\u0301\r\nmenu\x00  "}
+	if err := (validationProcessor{}).Before(jot); err != nil {
+		t.Fatalf("Before returned %v", err)
+	}
+	if want := "Caf\u00e9\nmenu"; jot.Text != want {
+		t.Errorf("Before stored %q, want %q", jot.Text, want)
+	}
+
+	// Only shares may be empty
+	originalID := 1
+	if err := (validationProcessor{}).Before(&PendingJot{Text: " ", OriginalID: &originalID}); err != nil {
+		t.Errorf("empty share rejected: %v", err)
+	}
+	err := (validationProcessor{}).Before(&PendingJot{Text: " "})
+	if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("empty jot returned %v, want a *ValidationError", err)
+	}
+}
+
+func TestPollProcessor(t *testing.T) {
+	jot := &PendingJot{Text: "Lunch?", Poll: &PollInput{Options: []string{" Pizza ", "", "Sushi  bar", ""}}}
+	if err := (pollProcessor{}).Before(jot); err != nil {
+		t.Fatalf("Before returned %v", err)
+	}
+	if got := strings.Join(jot.Poll.Options, "|"); got != "Pizza|Sushi bar" {
+		t.Errorf("options = %q, want blank ones dropped and spaces collapsed", got)
+	}
+
+	if err := (pollProcessor{}).Before(&PendingJot{Text: "No poll"}); err != nil {
+		t.Errorf("jot without a poll returned %v", err)
+	}
+
+	parentID := 1
+	invalid := []*PendingJot{
+		{Text: "Reply", ParentID: &parentID, Poll: &PollInput{Options: []string{"a", "b"}}},
+		{Text: "One option", Poll: &PollInput{Options: []string{"a", " "}}},
+		{Text: "Too many", Poll: &PollInput{Options: []string{"a", "b", "c", "d", "e", "f", "g"}}},
+		{Text: "Repeated", Poll: &PollInput{Options: []string{"Yes", "yes"}}},
+		{Text: "Too long", Poll: &PollInput{Options: []string{"a", strings.Repeat("x", maxPollOptionLength+1)}}},
+	}
+	for _, jot := range invalid {
+		err := (pollProcessor{}).Before(jot)
+		if validationErr, ok := err.(*ValidationError); !ok || validationErr.Fields["poll"] == "" {
+			t.Errorf("%s: Before returned %v, want a *ValidationError for the poll field", jot.Text, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// profiles.go
+//
+// This file handles user profiles: the display name and bio a user sets on
+// the settings page, and loading them for /u/{username} along with their
+// avatar (see avatars.go) and the date they joined.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Profile field limits
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 280
+)
+
+// Name returns the name to show for the user: their display name, or their
+// username if they haven't set one.
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// FetchUserProfile retrieves a user's public profile fields by username.
+// It returns sql.ErrNoRows if there is no such user.
+func FetchUserProfile(username string) (User, error) {
+	var user User
+	var createdAtStr string
+	err := db.QueryRow(`
+        SELECT id, username, display_name, bio, avatar_key, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+        FROM users
+        WHERE username = ?
+    `, username).Scan(&user.ID, &user.Username, &user.DisplayName, &user.Bio, &user.AvatarKey, &createdAtStr)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving user profile: %v", err)
+		}
+		return user, err
+	}
+
+	user.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	if err != nil {
+		log.Printf("Time parse error: %v", err)
+		return user, err
+	}
+	return user, nil
+}
+
+// FetchUserProfileByID retrieves a user's public profile fields by ID.
+func FetchUserProfileByID(userID int) (User, error) {
+	username, err := GetUsernameByID(userID)
+	if err != nil {
+		return User{}, err
+	}
+	return FetchUserProfile(username)
+}
+
+// ValidateProfileFields checks the user supplied profile fields and returns a
+// message describing the first problem found, or "" if they are valid.
+func ValidateProfileFields(displayName, bio string) string {
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return "Display name must be at most 50 characters"
+	}
+	if utf8.RuneCountInString(bio) > maxBioLength {
+		return "Bio must be at most 280 characters"
+	}
+	return ""
+}
+
+// UpdateProfile saves a user's display name and bio.
+func UpdateProfile(userID int, displayName, bio string) error {
+	_, err := db.Exec("UPDATE users SET display_name = ?, bio = ? WHERE id = ?",
+		strings.TrimSpace(displayName), strings.TrimSpace(bio), userID)
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+// reactions.go
+//
+// This file handles likes and emoji reactions on jots. Reactions are stored in
+// the reactions table keyed by (jot, user, emoji), so a user can leave each
+// reaction at most once per jot. Only the emoji listed in reactionTypes are accepted.
+
+package main
+
+import (
+	"log"
+)
+
+// ReactionType describes one of the reactions users can leave on a jot.
+type ReactionType struct {
+	Key   string // Identifier stored in the database and sent by forms
+	Emoji string // Emoji displayed to users
+}
+
+// reactionTypes is the bounded set of supported reactions, in display order.
+var reactionTypes = []ReactionType{
+	{Key: "like", Emoji: "👍"},
+	{Key: "heart", Emoji: "❤️"},
+	{Key: "laugh", Emoji: "😂"},
+	{Key: "wow", Emoji: "😮"},
+	{Key: "sad", Emoji: "😢"},
+	{Key: "party", Emoji: "🎉"},
+}
+
+// Reaction holds the aggregate count for one reaction type on a jot.
+type Reaction struct {
+	ReactionType
+	Count   int  // Number of users who left this reaction
+	Reacted bool // Whether the current user left this reaction
+}
+
+// IsValidReaction reports whether key is one of the supported reaction types.
+func IsValidReaction(key string) bool {
+	for _, rt := range reactionTypes {
+		if rt.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// SetReaction adds or removes a user's reaction on a jot. Both directions are
+// idempotent: adding an existing reaction or removing a missing one is a no-op.
+// When the counts change, the new totals are published to WebSocket clients.
+func SetReaction(jotID, userID int, key string, add bool) error {
+	var query string
+	if add {
+		query = "INSERT IGNORE INTO reactions (content_id, user_id, emoji) VALUES (?, ?, ?)"
+	} else {
+		query = "DELETE FROM reactions WHERE content_id = ? AND user_id = ? AND emoji = ?"
+	}
+	res, err := db.Exec(query, jotID, userID, key)
+	if err != nil {
+		log.Printf("Error updating reaction: %v", err)
+		return err
+	}
+
+	// Nothing changed, so there is nothing to tell clients about
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+
+	counts, err := FetchReactionCounts(jotID)
+	if err != nil {
+		return err
+	}
+	channelID, err := jotChannelID(jotID)
+	if err != nil {
+		return err
+	}
+	return PublishEvent(Event{Type: EventReactionsUpdated, JotID: jotID, ChannelID: channelID, Data: counts})
+}
+
+// FetchReactionCounts returns the number of reactions of each type on a jot,
+// keyed by reaction type. Types nobody has used are reported as zero.
+func FetchReactionCounts(jotID int) (map[string]int, error) {
+	rows, err := db.Query("SELECT emoji, COUNT(*) FROM reactions WHERE content_id = ? GROUP BY emoji", jotID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(reactionTypes))
+	for _, rt := range reactionTypes {
+		counts[rt.Key] = 0
+	}
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		counts[key] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// AttachReactions fills in the Reactions of every jot with aggregate counts,
+// marking the reactions left by userID. It issues a single query for all jots.
+func AttachReactions(jots []Jot, userID int) error {
+	if len(jots) == 0 {
+		return nil
+	}
+
+	// Build the IN clause for every jot on the page
+	ids := make([]int, len(jots))
+	index := make(map[int]int, len(jots))
+	for i, jot := range jots {
+		ids[i] = jot.ID
+		index[jot.ID] = i
+	}
+	placeholders, idArgs := inClause(ids)
+	args := append([]any{userID}, idArgs...)
+
+	rows, err := db.Query(`
+        SELECT content_id, emoji, COUNT(*), COALESCE(SUM(user_id = ?), 0) > 0
+        FROM reactions
+        WHERE content_id IN (`+placeholders+`)
+        GROUP BY content_id, emoji
+    `, args...)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	type aggregate struct {
+		count   int
+		reacted bool
+	}
+	totals := make(map[int]map[string]aggregate)
+	for rows.Next() {
+		var jotID int
+		var key string
+		var agg aggregate
+		if err := rows.Scan(&jotID, &key, &agg.count, &agg.reacted); err != nil {
+			log.Printf("Scan error: %v", err)
+			return err
+		}
+		if totals[jotID] == nil {
+			totals[jotID] = make(map[string]aggregate)
+		}
+		totals[jotID][key] = agg
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return err
+	}
+
+	// Every jot lists every reaction type so the template can render all buttons
+	for id, i := range index {
+		reactions := make([]Reaction, len(reactionTypes))
+		for j, rt := range reactionTypes {
+			agg := totals[id][rt.Key]
+			reactions[j] = Reaction{ReactionType: rt, Count: agg.count, Reacted: agg.reacted}
+		}
+		jots[i].Reactions = reactions
+	}
+	return nil
+}
@@ -13,7 +13,8 @@ var ctx = context.Background()
 // Define the Redis channel for new jots notifications
 const newJotsChannel = "new_jots_channel"
 
-func init() {
+// connectRedis connects to Redis when the program starts.
+func connectRedis() {
 	redisClient = redis.NewClient(&redis.Options{
 		Addr:     "localhost:6379", // Redis server address
 		Password: "",               // No password set
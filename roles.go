@@ -0,0 +1,460 @@
+// roles.go
+//
+// This file handles per-channel roles and moderation. Every member of a
+// channel has a role in channel_members: the owner, moderators appointed by
+// the owner, and ordinary members. Moderators can remove jots and ban users
+// from the channel.
+//
+// All channel permission checks go through Authorize, which loads the user's
+// access to a channel and applies the single policy in permits. The handlers
+// and the real-time hub (through channelAudience) use the same policy, and
+// visibleJotsClause is its SQL form for reads. Role changes and moderation
+// actions are recorded in channel_audit_log.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Channel roles, as stored in channel_members.role
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// ChannelAction is something a user may be allowed to do in a channel.
+type ChannelAction int
+
+// Actions checked by Authorize
+const (
+	ActionReadChannel      ChannelAction = iota // Read and follow the channel
+	ActionPostJot                               // Post and share jots in the channel
+	ActionReviewMembers                         // Approve and reject join requests, remove members
+	ActionRemoveJot                             // Remove other users' jots
+	ActionPinJot                                // Pin jots to the top of the channel
+	ActionBanUser                               // Ban and unban users
+	ActionSetPostingPolicy                      // Change who can post and the slow mode interval
+	ActionEditChannel                           // Change the channel's name, description and visibility
+	ActionManageRoles                           // Appoint and demote moderators
+	ActionManageInvites                         // Create and revoke invite links
+)
+
+// Audit log actions
+const (
+	AuditRoleChanged    = "role_changed"
+	AuditUserBanned     = "user_banned"
+	AuditUserUnbanned   = "user_unbanned"
+	AuditJotRemoved     = "jot_removed"
+	AuditPostingChanged = "posting_changed"
+	AuditJotPinned      = "jot_pinned"
+	AuditJotUnpinned    = "jot_unpinned"
+	AuditMemberApproved = "member_approved"
+	AuditMemberRemoved  = "member_removed"
+)
+
+// channelAccess is what the policy needs to know about a user in a channel.
+type channelAccess struct {
+	Visibility    string // The channel's visibility
+	PostingPolicy string // The channel's posting policy
+	Role          string // The user's role, empty if not a member
+	Banned        bool   // Whether the user is banned from the channel
+}
+
+// permits reports whether a user with the given access may perform an action.
+// It is the only place channel permissions are decided.
+func permits(access channelAccess, action ChannelAction) bool {
+	if access.Banned {
+		return false
+	}
+	switch action {
+	case ActionReadChannel:
+		return access.Visibility == VisibilityPublic || access.Role != ""
+	case ActionPostJot:
+		if access.PostingPolicy == PostingModerators {
+			return access.Role == RoleOwner || access.Role == RoleModerator
+		}
+		return access.Visibility == VisibilityPublic || access.Role != ""
+	case ActionReviewMembers, ActionRemoveJot, ActionPinJot, ActionBanUser, ActionSetPostingPolicy:
+		return access.Role == RoleOwner || access.Role == RoleModerator
+	case ActionEditChannel, ActionManageRoles, ActionManageInvites:
+		return access.Role == RoleOwner
+	}
+	return false
+}
+
+// outranks reports whether a user with role may act on a user with target
+// role, e.g. remove or ban them. The owner outranks everyone; moderators
+// only outrank members and non-members.
+func outranks(role, target string) bool {
+	switch role {
+	case RoleOwner:
+		return target != RoleOwner
+	case RoleModerator:
+		return target != RoleOwner && target != RoleModerator
+	}
+	return false
+}
+
+// isBanned checks if a user is banned from a channel.
+func isBanned(userID, channelID int) (bool, error) {
+	var banned bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM channel_bans WHERE channel_id = ? AND user_id = ?)", channelID, userID).Scan(&banned)
+	if err != nil {
+		log.Printf("Error checking channel ban: %v", err)
+	}
+	return banned, err
+}
+
+// loadChannelAccess loads a user's role and ban for a channel along with the
+// channel's visibility and posting policy. It returns sql.ErrNoRows if the
+// channel does not exist.
+func loadChannelAccess(userID, channelID int) (channelAccess, error) {
+	var access channelAccess
+	var role sql.NullString
+	err := db.QueryRow(`
+        SELECT c.visibility, c.posting_policy,
+               (SELECT m.role FROM channel_members m WHERE m.channel_id = c.id AND m.user_id = ?),
+               EXISTS(SELECT 1 FROM channel_bans b WHERE b.channel_id = c.id AND b.user_id = ?)
+        FROM channels c
+        WHERE c.id = ?
+    `, userID, userID, channelID).Scan(&access.Visibility, &access.PostingPolicy, &role, &access.Banned)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading channel access: %v", err)
+		}
+		return access, err
+	}
+	access.Role = role.String
+	return access, nil
+}
+
+// Authorize checks if a user may perform an action in a channel.
+// It returns sql.ErrNoRows if the channel does not exist.
+func Authorize(userID, channelID int, action ChannelAction) (bool, error) {
+	access, err := loadChannelAccess(userID, channelID)
+	if err != nil {
+		return false, err
+	}
+	return permits(access, action), nil
+}
+
+// channelAudience returns a function reporting which users may receive
+// real-time updates for a channel, applying the same policy as Authorize.
+func channelAudience(channelID int) (func(userID int) bool, error) {
+	var visibility string
+	err := db.QueryRow("SELECT visibility FROM channels WHERE id = ?", channelID).Scan(&visibility)
+	if err != nil {
+		log.Printf("Error checking channel visibility: %v", err)
+		return nil, err
+	}
+
+	roles := make(map[int]string)
+	rows, err := db.Query("SELECT user_id, role FROM channel_members WHERE channel_id = ?", channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		roles[userID] = role
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+
+	banned, err := fetchBannedIDs(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(userID int) bool {
+		access := channelAccess{Visibility: visibility, Role: roles[userID], Banned: banned[userID]}
+		return permits(access, ActionReadChannel)
+	}, nil
+}
+
+// fetchBannedIDs retrieves the set of users banned from a channel.
+func fetchBannedIDs(channelID int) (map[int]bool, error) {
+	rows, err := db.Query("SELECT user_id FROM channel_bans WHERE channel_id = ?", channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	banned := make(map[int]bool)
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		banned[userID] = true
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return banned, nil
+}
+
+// SetMemberRole changes a member's role to moderator or member and records the
+// change in the audit log. The owner's role cannot be changed. It reports
+// false if the user is not a member whose role can be changed.
+func SetMemberRole(channelID, actorID, userID int, role string) (bool, error) {
+	if role != RoleModerator && role != RoleMember {
+		return false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var oldRole string
+	err = tx.QueryRow("SELECT role FROM channel_members WHERE channel_id = ? AND user_id = ? FOR UPDATE", channelID, userID).Scan(&oldRole)
+	if err == sql.ErrNoRows || oldRole == RoleOwner {
+		return false, nil
+	} else if err != nil {
+		log.Printf("Error fetching member role: %v", err)
+		return false, err
+	}
+	if oldRole == role {
+		return true, nil
+	}
+
+	if _, err = tx.Exec("UPDATE channel_members SET role = ? WHERE channel_id = ? AND user_id = ?", role, channelID, userID); err != nil {
+		log.Printf("Error updating member role: %v", err)
+		return false, err
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &userID, AuditRoleChanged, oldRole+" -> "+role); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing role change: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// BanUser bans a user from a channel, removing their membership, follow and
+// any pending join request, and records the ban in the audit log. The owner
+// cannot be banned; it reports false in that case.
+func BanUser(channelID, actorID, userID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var ownerID sql.NullInt64
+	if err = tx.QueryRow("SELECT owner_id FROM channels WHERE id = ?", channelID).Scan(&ownerID); err != nil {
+		log.Printf("Error fetching channel owner: %v", err)
+		return false, err
+	}
+	if ownerID.Valid && int(ownerID.Int64) == userID {
+		return false, nil
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO channel_bans (channel_id, user_id, banned_by) VALUES (?, ?, ?)", channelID, userID, actorID)
+	if err != nil {
+		log.Printf("Error saving ban: %v", err)
+		return false, err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return true, nil
+	}
+
+	for _, query := range []string{
+		"DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?",
+		"DELETE FROM channel_join_requests WHERE channel_id = ? AND user_id = ?",
+	} {
+		if _, err = tx.Exec(query, channelID, userID); err != nil {
+			log.Printf("Error removing banned user: %v", err)
+			return false, err
+		}
+	}
+	res, err = tx.Exec("DELETE FROM user_follows WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error removing banned user: %v", err)
+		return false, err
+	}
+	if unfollowed, err := res.RowsAffected(); err == nil && unfollowed > 0 {
+		if err := adjustFollowerCount(tx, channelID, -unfollowed); err != nil {
+			return false, err
+		}
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &userID, AuditUserBanned, ""); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing ban: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// UnbanUser lifts a user's ban from a channel and records it in the audit log.
+// The user has to rejoin or be invited again to regain membership.
+func UnbanUser(channelID, actorID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM channel_bans WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	if err != nil {
+		log.Printf("Error removing ban: %v", err)
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &userID, AuditUserUnbanned, ""); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing unban: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchBannedUsers retrieves the users banned from a channel, most recent first.
+func FetchBannedUsers(channelID int) ([]ChannelMember, error) {
+	return fetchChannelUsers(`
+        SELECT users.id, users.username, '', DATE_FORMAT(channel_bans.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM channel_bans
+        JOIN users ON channel_bans.user_id = users.id
+        WHERE channel_bans.channel_id = ?
+        ORDER BY channel_bans.created_at DESC
+    `, channelID)
+}
+
+// RemoveJot deletes a jot from its channel as a moderation action, records it
+// in the audit log and tells connected clients to drop it. Replies to the jot
+// and its attached files are removed with it. It returns sql.ErrNoRows if the jot does not exist.
+func RemoveJot(jotID, actorID int) error {
+	jot, err := FetchJotByID(jotID)
+	if err != nil {
+		return err
+	}
+	channelID, err := jotChannelID(jotID)
+	if err != nil {
+		return err
+	}
+	attachments, err := fetchAttachments([]int{jotID})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM content WHERE id = ?", jotID); err != nil {
+		log.Printf("Error removing jot: %v", err)
+		return err
+	}
+	authorID, err := getUserIDByUsername(tx, jot.Username)
+	if err != nil {
+		return err
+	}
+	if err = writeAuditLog(tx, channelID, actorID, &authorID, AuditJotRemoved, jot.Text); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing jot removal: %v", err)
+		return err
+	}
+	DeleteAttachmentFiles(attachments[jotID])
+
+	return PublishEvent(Event{Type: EventJotRemoved, JotID: jotID, ChannelID: channelID})
+}
+
+// getUserIDByUsername looks up a user's ID inside a transaction.
+func getUserIDByUsername(tx *sql.Tx, username string) (int, error) {
+	var userID int
+	err := tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		log.Printf("Error retrieving user ID: %v", err)
+	}
+	return userID, err
+}
+
+// AuditEntry is one entry of a channel's audit log.
+type AuditEntry struct {
+	Actor     string    // Username of the user who acted
+	Target    string    // Username of the affected user, empty if none
+	Action    string    // One of the Audit* constants
+	Details   string    // Action specific details, e.g. the old and new role
+	CreatedAt time.Time // Timestamp of the action
+}
+
+// writeAuditLog records a role change or moderation action.
+func writeAuditLog(tx *sql.Tx, channelID, actorID int, targetID *int, action, details string) error {
+	_, err := tx.Exec("INSERT INTO channel_audit_log (channel_id, actor_id, target_user_id, action, details) VALUES (?, ?, ?, ?, ?)", channelID, actorID, targetID, action, details)
+	if err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	return err
+}
+
+// FetchAuditLog retrieves the most recent audit log entries of a channel, newest first.
+func FetchAuditLog(channelID int) ([]AuditEntry, error) {
+	rows, err := db.Query(`
+        SELECT actor.username, COALESCE(target.username, ''), a.action, a.details,
+               DATE_FORMAT(a.created_at, '%Y-%m-%d %H:%i:%s')
+        FROM channel_audit_log AS a
+        JOIN users AS actor ON actor.id = a.actor_id
+        LEFT JOIN users AS target ON target.id = a.target_user_id
+        WHERE a.channel_id = ?
+        ORDER BY a.created_at DESC, a.id DESC
+        LIMIT 100
+    `, channelID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var createdAtStr string
+		if err := rows.Scan(&entry.Actor, &entry.Target, &entry.Action, &entry.Details, &createdAtStr); err != nil {
+			log.Printf("Scan error: %v", err)
+			return nil, err
+		}
+		entry.CreatedAt, err = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		if err != nil {
+			log.Printf("Time parse error: %v", err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		return nil, err
+	}
+	return entries, nil
+}
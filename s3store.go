@@ -0,0 +1,187 @@
+// s3store.go
+//
+// This file implements BlobStore on top of an S3 compatible object store
+// (Amazon S3, MinIO, Ceph and the like). Requests are signed with AWS
+// Signature Version 4 using only the standard library, and objects are
+// addressed path-style (endpoint/bucket/key), which every implementation
+// supports. A local MinIO server makes a convenient stand-in for development.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3BlobStore stores files as objects in an S3 bucket.
+type S3BlobStore struct {
+	endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	publicURL string // URL prefix objects are served from, e.g. a CDN; the bucket URL when empty
+	client    *http.Client
+}
+
+// NewS3BlobStore creates a store for bucket. An empty endpoint means Amazon
+// S3 in the given region, and an empty region means us-east-1.
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey, publicURL string) *S3BlobStore {
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if publicURL == "" {
+		publicURL = strings.TrimSuffix(endpoint, "/") + "/" + bucket
+	}
+	return &S3BlobStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Put uploads the contents of r as the object key.
+func (s *S3BlobStore) Put(key string, r io.Reader, contentType string) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return s.do(req, body, http.StatusOK)
+}
+
+// Delete removes the object key. S3 reports success for missing objects too.
+func (s *S3BlobStore) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, nil, http.StatusNoContent, http.StatusOK)
+}
+
+// URL returns the public address of the object key.
+func (s *S3BlobStore) URL(key string) string {
+	return s.publicURL + "/" + s3EscapePath(key)
+}
+
+// objectURL returns the API address of the object key.
+func (s *S3BlobStore) objectURL(key string) string {
+	return s.endpoint + "/" + s3EscapePath(s.bucket) + "/" + s3EscapePath(key)
+}
+
+// do signs and sends a request and checks it got one of the expected statuses.
+func (s *S3BlobStore) do(req *http.Request, body []byte, expected ...int) error {
+	s.sign(req, sha256Hex(body), time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("Error calling object store: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("object store %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, message)
+	log.Printf("Error calling object store: %v", err)
+	return err
+}
+
+// sign adds AWS Signature Version 4 headers to req. Every header already set
+// on the request is signed, along with the host.
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath percent-encodes every character of a key except unreserved
+// ones and the slashes between its segments, as Signature Version 4 expects.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
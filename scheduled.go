@@ -0,0 +1,342 @@
+// scheduled.go
+//
+// This file handles jots scheduled to be posted later. A scheduled jot waits
+// in the scheduled_jots table until its time comes, and can be edited or
+// cancelled until then. Publish times are stored in UTC next to the author's
+// timezone, which is only used to show the time back the way it was entered.
+//
+// A background worker on every server instance publishes due jots through
+// SaveContentToDB, the same path as the composer, so they are validated,
+// indexed and announced like any other jot. Before publishing, an instance
+// claims the jot by moving it from "pending" to "publishing" with a single
+// conditional UPDATE; only one instance can win that race. The claim is a
+// lease: if the instance dies while publishing, another one takes the jot
+// over once scheduledJotClaimTimeout has passed since it was claimed. The
+// scheduled jot is deleted in the same transaction that inserts the posted
+// jot, and an instance whose DELETE finds it gone rolls back, so each jot is
+// published, and its real-time events are sent, exactly once.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+	_ "time/tzdata" // Timezones must load even on hosts without a zoneinfo database
+)
+
+// Statuses of a scheduled jot, as stored in scheduled_jots.status
+const (
+	ScheduledPending    = "pending"    // Waiting for its publish time
+	ScheduledPublishing = "publishing" // Claimed by a worker that is publishing it
+	ScheduledFailed     = "failed"     // Rejected when it was published, e.g. by the channel's posting policy
+)
+
+const (
+	scheduleInputLayout  = "2006-01-02T15:04" // Format of <input type="datetime-local"> values
+	maxScheduleAhead     = 365 * 24 * time.Hour
+	scheduledJotInterval = 15 * time.Second // How often the worker looks for due jots
+	scheduledJotBatch    = 50               // Most jots published per check
+
+	// How long a claimed jot may stay "publishing" before another worker
+	// assumes its instance died and publishes it instead
+	scheduledJotClaimTimeout = 5 * time.Minute
+)
+
+// ScheduledJot is a jot waiting to be published.
+type ScheduledJot struct {
+	ID          int
+	Text        string
+	ChannelID   *int
+	ChannelName string    // Empty when the jot is not for a channel
+	PublishAt   time.Time // In UTC
+	Timezone    string    // IANA name of the author's timezone when it was scheduled
+	Status      string    // One of the Scheduled* constants
+	Error       string    // Why publishing failed, for failed jots
+}
+
+// Local returns the publish time in the timezone it was scheduled in.
+func (s ScheduledJot) Local() time.Time {
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		return s.PublishAt.In(loc)
+	}
+	return s.PublishAt
+}
+
+// InputValue returns the publish time formatted for a datetime-local input.
+func (s ScheduledJot) InputValue() string {
+	return s.Local().Format(scheduleInputLayout)
+}
+
+// validateScheduledJot normalizes and validates the text of a scheduled jot
+// and parses its publish time, entered as a datetime-local value in
+// timezone. Unknown timezones fall back to UTC. Problems are reported as a
+// *ValidationError for the "content" and "publish_at" fields.
+func validateScheduledJot(content, publishAt, timezone string) (string, time.Time, string, error) {
+	invalid := &ValidationError{}
+	text, err := ValidateJotText(content, false)
+	if validationErr, ok := err.(*ValidationError); ok {
+		invalid = validationErr
+	} else if err != nil {
+		return "", time.Time{}, "", err
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || timezone == "Local" {
+		loc, timezone = time.UTC, "UTC"
+	}
+	when, err := time.ParseInLocation(scheduleInputLayout, publishAt, loc)
+	switch {
+	case err != nil:
+		invalid.add("publish_at", "Pick a date and time to publish the jot")
+	case !when.After(time.Now()):
+		invalid.add("publish_at", "Pick a time in the future")
+	case when.After(time.Now().Add(maxScheduleAhead)):
+		invalid.add("publish_at", "Jots can be scheduled at most a year ahead")
+	}
+
+	if len(invalid.Fields) > 0 {
+		return "", time.Time{}, "", invalid
+	}
+	return text, when.UTC(), timezone, nil
+}
+
+// ScheduleJot stores a jot to be published at publishAt, a datetime-local
+// value in the author's timezone. It returns a *ValidationError if the text
+// or time is invalid. The channel's posting policy is checked when the jot
+// is published.
+func ScheduleJot(userID int, content string, channelID *int, publishAt, timezone string) error {
+	text, when, timezone, err := validateScheduledJot(content, publishAt, timezone)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO scheduled_jots (user_id, text, channel_id, publish_at, timezone, status) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, text, channelID, when.Format("2006-01-02 15:04:05"), timezone, ScheduledPending)
+	if err != nil {
+		log.Printf("Error scheduling jot: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchScheduledJots returns a user's scheduled jots that have not been
+// published yet, including failed ones, soonest first.
+func FetchScheduledJots(userID int) ([]ScheduledJot, error) {
+	rows, err := db.Query(`
+        SELECT s.id, s.text, s.channel_id, COALESCE(c.name, ''), DATE_FORMAT(s.publish_at, '%Y-%m-%d %H:%i:%s'), s.timezone, s.status, COALESCE(s.error, '')
+        FROM scheduled_jots s
+        LEFT JOIN channels c ON c.id = s.channel_id
+        WHERE s.user_id = ?
+        ORDER BY s.publish_at, s.id
+    `, userID)
+	if err != nil {
+		log.Printf("Error fetching scheduled jots: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scheduled []ScheduledJot
+	for rows.Next() {
+		var s ScheduledJot
+		var channelID sql.NullInt64
+		var publishAt string
+		if err := rows.Scan(&s.ID, &s.Text, &channelID, &s.ChannelName, &publishAt, &s.Timezone, &s.Status, &s.Error); err != nil {
+			log.Printf("Error scanning scheduled jot: %v", err)
+			return nil, err
+		}
+		if channelID.Valid {
+			id := int(channelID.Int64)
+			s.ChannelID = &id
+		}
+		s.PublishAt, _ = time.Parse("2006-01-02 15:04:05", publishAt)
+		scheduled = append(scheduled, s)
+	}
+	return scheduled, rows.Err()
+}
+
+// UpdateScheduledJot changes the text and publish time of a pending
+// scheduled jot. It returns a *ValidationError for invalid input, and
+// sql.ErrNoRows if the user has no such jot waiting to be published.
+// A failed jot that is edited is retried at its new time.
+func UpdateScheduledJot(id, userID int, content, publishAt, timezone string) error {
+	text, when, timezone, err := validateScheduledJot(content, publishAt, timezone)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// MySQL only counts the rows an UPDATE changes, so saving a jot unchanged
+	// affects none; look it up first instead, locked so no worker claims it
+	var found int
+	err = tx.QueryRow("SELECT id FROM scheduled_jots WHERE id = ? AND user_id = ? AND status IN (?, ?) FOR UPDATE",
+		id, userID, ScheduledPending, ScheduledFailed).Scan(&found)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error retrieving scheduled jot: %v", err)
+		}
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE scheduled_jots SET text = ?, publish_at = ?, timezone = ?, status = ?, error = NULL WHERE id = ?",
+		text, when.Format("2006-01-02 15:04:05"), timezone, ScheduledPending, id)
+	if err != nil {
+		log.Printf("Error updating scheduled jot: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing scheduled jot update: %v", err)
+		return err
+	}
+	return nil
+}
+
+// CancelScheduledJot deletes a scheduled jot that has not been published. It
+// returns sql.ErrNoRows if the user has no such jot, or it is being published.
+func CancelScheduledJot(id, userID int) error {
+	res, err := db.Exec("DELETE FROM scheduled_jots WHERE id = ? AND user_id = ? AND status IN (?, ?)", id, userID, ScheduledPending, ScheduledFailed)
+	if err != nil {
+		log.Printf("Error cancelling scheduled jot: %v", err)
+		return err
+	}
+	return requireAffected(res)
+}
+
+// requireAffected returns sql.ErrNoRows if a statement changed no rows.
+func requireAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Error checking affected rows: %v", err)
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// startScheduledJotWorker starts publishing scheduled jots in the background.
+func startScheduledJotWorker() {
+	go func() {
+		ticker := time.NewTicker(scheduledJotInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			publishDueJots()
+		}
+	}()
+}
+
+// publishDueJots publishes the scheduled jots whose time has come, and those
+// whose claim has run out.
+func publishDueJots() {
+	rows, err := db.Query(`
+        SELECT id FROM scheduled_jots
+        WHERE (status = ? AND publish_at <= UTC_TIMESTAMP())
+           OR (status = ? AND claimed_at <= UTC_TIMESTAMP() - INTERVAL ? SECOND)
+        ORDER BY publish_at LIMIT ?
+    `, ScheduledPending, ScheduledPublishing, int(scheduledJotClaimTimeout.Seconds()), scheduledJotBatch)
+	if err != nil {
+		log.Printf("Error fetching due scheduled jots: %v", err)
+		return
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning scheduled jot: %v", err)
+			break
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		publishScheduledJot(id)
+	}
+}
+
+// publishScheduledJot claims a due jot and posts it. Another instance may
+// have claimed it first, in which case it is left alone unless its claim has
+// run out. A jot whose author can no longer post it is marked failed, and the
+// author is told why.
+func publishScheduledJot(id int) {
+	res, err := db.Exec(`
+        UPDATE scheduled_jots SET status = ?, claimed_at = UTC_TIMESTAMP()
+        WHERE id = ? AND (status = ? OR (status = ? AND claimed_at <= UTC_TIMESTAMP() - INTERVAL ? SECOND))
+    `, ScheduledPublishing, id, ScheduledPending, ScheduledPublishing, int(scheduledJotClaimTimeout.Seconds()))
+	if err != nil {
+		log.Printf("Error claiming scheduled jot: %v", err)
+		return
+	}
+	if requireAffected(res) != nil {
+		return
+	}
+
+	var s ScheduledJot
+	var userID int
+	var channelID sql.NullInt64
+	var publishAt string
+	err = db.QueryRow("SELECT user_id, text, channel_id, DATE_FORMAT(publish_at, '%Y-%m-%d %H:%i:%s'), timezone FROM scheduled_jots WHERE id = ?", id).
+		Scan(&userID, &s.Text, &channelID, &publishAt, &s.Timezone)
+	if err != nil {
+		log.Printf("Error fetching scheduled jot: %v", err)
+		releaseScheduledJot(id)
+		return
+	}
+	if channelID.Valid {
+		id := int(channelID.Int64)
+		s.ChannelID = &id
+	}
+	s.PublishAt, _ = time.Parse("2006-01-02 15:04:05", publishAt)
+
+	err = saveJot(&PendingJot{Text: s.Text, UserID: userID, ChannelID: s.ChannelID, ScheduledID: id}, 0)
+	if err == nil || err == sql.ErrNoRows {
+		// Published, by this instance or by one that took over the claim
+		return
+	}
+
+	// Jots the author is not allowed to post any more are reported back;
+	// anything else is an internal error, so the message stays generic
+	reason := "It could not be published"
+	if validationErr, ok := err.(*ValidationError); ok {
+		reason = validationErr.Error()
+	} else if postingErr, ok := err.(*PostingError); ok {
+		reason = postingErr.Message
+	}
+	if _, err := db.Exec("UPDATE scheduled_jots SET status = ?, claimed_at = NULL, error = ? WHERE id = ?", ScheduledFailed, reason, id); err != nil {
+		log.Printf("Error marking scheduled jot failed: %v", err)
+	}
+	message := fmt.Sprintf("Your jot scheduled for %s was not posted: %s", s.Local().Format("Jan 2, 2006 at 3:04pm MST"), reason)
+	CreateNotification(userID, userID, "scheduled_failed", 0, message)
+}
+
+// removeScheduledJot deletes the scheduled jot id, if not 0, as it is
+// published in tx. It returns sql.ErrNoRows if the jot is gone, because
+// another instance took over the claim and published it first.
+func removeScheduledJot(tx *sql.Tx, id int) error {
+	if id == 0 {
+		return nil
+	}
+	res, err := tx.Exec("DELETE FROM scheduled_jots WHERE id = ? AND status = ?", id, ScheduledPublishing)
+	if err != nil {
+		log.Printf("Error removing published scheduled jot: %v", err)
+		return err
+	}
+	return requireAffected(res)
+}
+
+// releaseScheduledJot gives up the claim on a jot that could not be
+// published for now, so the next check tries it again.
+func releaseScheduledJot(id int) {
+	_, err := db.Exec("UPDATE scheduled_jots SET status = ?, claimed_at = NULL WHERE id = ? AND status = ?", ScheduledPending, id, ScheduledPublishing)
+	if err != nil {
+		log.Printf("Error releasing scheduled jot: %v", err)
+	}
+}
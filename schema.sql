@@ -0,0 +1,369 @@
+-- schema.sql
+--
+-- Schema changes for features added on top of the original tables
+-- (users, content, channels, user_follows). Apply the statements in order
+-- against the application's MySQL database.
+
+-- Threaded replies: a reply points at the jot it answers and at the top-level
+-- jot of its thread so a whole thread can be loaded with one query.
+ALTER TABLE content
+    ADD COLUMN parent_id INT NULL,
+    ADD COLUMN root_id INT NULL,
+    ADD INDEX idx_content_parent (parent_id),
+    ADD INDEX idx_content_root (root_id),
+    ADD CONSTRAINT fk_content_parent FOREIGN KEY (parent_id) REFERENCES content (id) ON DELETE CASCADE,
+    ADD CONSTRAINT fk_content_root FOREIGN KEY (root_id) REFERENCES content (id) ON DELETE CASCADE;
+
+-- Persisted notifications, e.g. when someone replies to a user's jot.
+CREATE TABLE notifications (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    actor_id INT NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    jot_id INT NULL,
+    message VARCHAR(255) NOT NULL,
+    is_read BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_notifications_user (user_id, created_at),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (jot_id) REFERENCES content (id) ON DELETE CASCADE
+);
+
+-- Likes and emoji reactions. A user can leave each reaction once per jot.
+CREATE TABLE reactions (
+    content_id INT NOT NULL,
+    user_id INT NOT NULL,
+    emoji VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (content_id, user_id, emoji),
+    INDEX idx_reactions_user (user_id),
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Re-jots and quotes. original_id points at the shared jot; the text is empty for
+-- a plain re-jot and holds the commentary for a quote. There is deliberately no
+-- foreign key so that shares survive the original being deleted and can render
+-- a placeholder instead.
+ALTER TABLE content
+    ADD COLUMN original_id INT NULL,
+    ADD INDEX idx_content_original (original_id);
+
+-- Hashtags, extracted from jot text when a jot is saved.
+CREATE TABLE tags (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE TABLE jot_tags (
+    content_id INT NOT NULL,
+    tag_id INT NOT NULL,
+    PRIMARY KEY (content_id, tag_id),
+    INDEX idx_jot_tags_tag (tag_id, content_id),
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+);
+
+-- @mentions resolved against the users table when a jot is saved.
+CREATE TABLE mentions (
+    content_id INT NOT NULL,
+    user_id INT NOT NULL,
+    PRIMARY KEY (content_id, user_id),
+    INDEX idx_mentions_user (user_id),
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Channel creation from the app: unique slug, description, optional emoji icon
+-- and the owning user. Existing channels need a slug before the NOT NULL/UNIQUE
+-- constraints are added; the UPDATE derives one from the ID.
+ALTER TABLE channels
+    ADD COLUMN slug VARCHAR(50) NULL,
+    ADD COLUMN description VARCHAR(280) NOT NULL DEFAULT '',
+    ADD COLUMN icon VARCHAR(32) NOT NULL DEFAULT '',
+    ADD COLUMN owner_id INT NULL,
+    ADD CONSTRAINT fk_channels_owner FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE SET NULL;
+UPDATE channels SET slug = CONCAT('channel-', id) WHERE slug IS NULL;
+ALTER TABLE channels
+    MODIFY COLUMN slug VARCHAR(50) NOT NULL,
+    ADD UNIQUE INDEX idx_channels_slug (slug),
+    ADD UNIQUE INDEX idx_channels_name (name);
+
+-- Old slugs of renamed channels, so existing links redirect to the new slug.
+CREATE TABLE channel_slug_redirects (
+    slug VARCHAR(50) PRIMARY KEY,
+    channel_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE
+);
+
+-- Private and invite-only channels. Membership is separate from following:
+-- members may read a non-public channel, followers choose what they see.
+ALTER TABLE channels
+    ADD COLUMN visibility ENUM('public', 'private', 'invite') NOT NULL DEFAULT 'public';
+
+CREATE TABLE channel_memberships (
+    channel_id INT NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    INDEX idx_channel_memberships_user (user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Owners of channels created in the app are members of them.
+INSERT IGNORE INTO channel_memberships (channel_id, user_id)
+    SELECT id, owner_id FROM channels WHERE owner_id IS NOT NULL;
+
+-- Requests to join private channels, pending the owner's approval.
+CREATE TABLE channel_join_requests (
+    channel_id INT NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Invite links. expires_at is stored in UTC; NULL expires_at or max_uses means no limit.
+CREATE TABLE channel_invites (
+    token CHAR(32) PRIMARY KEY,
+    channel_id INT NOT NULL,
+    created_by INT NOT NULL,
+    expires_at DATETIME NULL,
+    max_uses INT NULL,
+    uses INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_channel_invites_channel (channel_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Channel roles. Memberships become channel_members with a role: the owner,
+-- moderators appointed by the owner, and ordinary members.
+RENAME TABLE channel_memberships TO channel_members;
+ALTER TABLE channel_members
+    ADD COLUMN role ENUM('owner', 'moderator', 'member') NOT NULL DEFAULT 'member';
+UPDATE channel_members
+    JOIN channels ON channels.id = channel_members.channel_id AND channels.owner_id = channel_members.user_id
+    SET channel_members.role = 'owner';
+
+-- Users banned from a channel by its owner or a moderator.
+CREATE TABLE channel_bans (
+    channel_id INT NOT NULL,
+    user_id INT NOT NULL,
+    banned_by INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    INDEX idx_channel_bans_user (user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (banned_by) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Audit log of role changes and moderation actions in a channel.
+CREATE TABLE channel_audit_log (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    channel_id INT NOT NULL,
+    actor_id INT NOT NULL,
+    target_user_id INT NULL,
+    action VARCHAR(32) NOT NULL,
+    details TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_channel_audit_log_channel (channel_id, created_at),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (target_user_id) REFERENCES users (id) ON DELETE SET NULL
+);
+
+-- Posting policies: open to every reader, moderators only (announcement
+-- channels), or slow mode with a per-user interval in seconds.
+ALTER TABLE channels
+    ADD COLUMN posting_policy ENUM('open', 'moderators', 'slow') NOT NULL DEFAULT 'open',
+    ADD COLUMN slow_mode_seconds INT NOT NULL DEFAULT 0;
+CREATE INDEX idx_content_channel_user ON content (channel_id, user_id, created_at);
+
+-- Jots pinned to the top of a channel by its moderators, in position order.
+CREATE TABLE channel_pins (
+    channel_id INT NOT NULL,
+    content_id INT NOT NULL,
+    position INT NOT NULL,
+    pinned_by INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, content_id),
+    INDEX idx_channel_pins_position (channel_id, position),
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE,
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (pinned_by) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Channel discovery: an optional category to browse by, and an index for
+-- counting a channel's recent jots when sorting by activity.
+ALTER TABLE channels
+    ADD COLUMN category VARCHAR(32) NOT NULL DEFAULT '',
+    ADD INDEX idx_channels_category (category);
+CREATE INDEX idx_content_channel_created ON content (channel_id, created_at);
+CREATE INDEX idx_user_follows_channel ON user_follows (channel_id, user_id);
+
+-- Denormalized follower counts, maintained by ToggleFollowChannel in the same
+-- transaction as the follow itself. The UPDATE backfills existing channels.
+ALTER TABLE channels
+    ADD COLUMN follower_count INT UNSIGNED NOT NULL DEFAULT 0;
+UPDATE channels
+    SET follower_count = (SELECT COUNT(*) FROM user_follows WHERE user_follows.channel_id = channels.id);
+
+-- User-to-user follows. Followed users' jots appear in the follower's home feed.
+CREATE TABLE user_followers (
+    follower_id INT NOT NULL,
+    followed_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (follower_id, followed_id),
+    INDEX idx_user_followers_followed (followed_id, created_at),
+    FOREIGN KEY (follower_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (followed_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_content_user_created ON content (user_id, created_at);
+
+-- User profiles. Users who signed up before this change get the time the
+-- column was added as their join date. avatar_key is the blob store prefix of
+-- the resized avatar images; users without one get a generated identicon.
+ALTER TABLE users
+    ADD COLUMN display_name VARCHAR(50) NOT NULL DEFAULT '',
+    ADD COLUMN bio VARCHAR(280) NOT NULL DEFAULT '',
+    ADD COLUMN avatar_key VARCHAR(100) NOT NULL DEFAULT '',
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+-- Images and files attached to jots. size is the stored size in bytes, which
+-- counts towards the uploader's quota; thumb_key is empty for non-images.
+CREATE TABLE attachments (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    content_id INT NOT NULL,
+    user_id INT NOT NULL,
+    position TINYINT UNSIGNED NOT NULL,
+    kind ENUM('image', 'file') NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size INT UNSIGNED NOT NULL,
+    width INT UNSIGNED NOT NULL DEFAULT 0,
+    height INT UNSIGNED NOT NULL DEFAULT 0,
+    alt_text VARCHAR(500) NOT NULL DEFAULT '',
+    blob_key VARCHAR(255) NOT NULL,
+    thumb_key VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_attachments_content (content_id, position),
+    INDEX idx_attachments_user (user_id),
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Link previews, cached per URL (keyed by its SHA-256) and shared by every jot
+-- linking to it. Failed fetches are cached too, with ok = FALSE.
+CREATE TABLE link_previews (
+    url_hash CHAR(64) PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    title VARCHAR(300) NOT NULL DEFAULT '',
+    description VARCHAR(500) NOT NULL DEFAULT '',
+    image_url VARCHAR(2048) NOT NULL DEFAULT '',
+    site_name VARCHAR(300) NOT NULL DEFAULT '',
+    ok BOOLEAN NOT NULL,
+    fetched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE content_link_previews (
+    content_id INT PRIMARY KEY,
+    url_hash CHAR(64) NOT NULL,
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE,
+    FOREIGN KEY (url_hash) REFERENCES link_previews (url_hash) ON DELETE CASCADE
+);
+
+-- Jot text formatting. The HTML rendered from a jot's Markdown is cached next
+-- to the raw text; render_version records which version of the renderer
+-- produced it, and outdated or missing renderings are redone on display.
+ALTER TABLE content
+    ADD COLUMN rendered_html MEDIUMTEXT NULL,
+    ADD COLUMN render_version SMALLINT UNSIGNED NOT NULL DEFAULT 0;
+
+-- Scheduled jots. A jot waits here until publish_at (UTC) and is then posted
+-- by the scheduled jot worker; timezone is the author's, used to show the
+-- time as it was entered. Moving status from 'pending' to 'publishing' claims
+-- a jot for one server instance until claimed_at plus the claim timeout, after
+-- which another instance may take it over; published jots are deleted, and
+-- jots that were rejected when published stay as 'failed' with the reason in
+-- error.
+CREATE TABLE scheduled_jots (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    text TEXT NOT NULL,
+    channel_id INT NULL,
+    publish_at DATETIME NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    status ENUM('pending', 'publishing', 'failed') NOT NULL DEFAULT 'pending',
+    claimed_at DATETIME NULL,
+    error VARCHAR(255) NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_scheduled_jots_due (status, publish_at),
+    INDEX idx_scheduled_jots_user (user_id, publish_at),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE
+);
+
+-- Drafts. Each user has at most one draft per target channel; channel_key is
+-- the channel ID, or 0 for jots outside any channel, since the NULLs in
+-- channel_id would never collide in a unique index.
+CREATE TABLE drafts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    channel_id INT NULL,
+    channel_key INT AS (COALESCE(channel_id, 0)) STORED,
+    text TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE INDEX idx_drafts_target (user_id, channel_key),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels (id) ON DELETE CASCADE
+);
+
+-- Ephemeral jots. expires_at (UTC) is when the jot disappears, NULL for
+-- permanent jots; the reaper looks up expired jots by it.
+ALTER TABLE content
+    ADD COLUMN expires_at DATETIME NULL,
+    ADD INDEX idx_content_expires (expires_at);
+
+-- Polls. A jot has at most one poll; poll_voters records who voted, so each
+-- user votes once, and poll_votes the options they picked.
+CREATE TABLE polls (
+    content_id INT PRIMARY KEY,
+    multiple BOOLEAN NOT NULL DEFAULT FALSE,
+    closes_at DATETIME NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (content_id) REFERENCES content (id) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_options (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    content_id INT NOT NULL,
+    position TINYINT UNSIGNED NOT NULL,
+    label VARCHAR(400) NOT NULL,
+    UNIQUE INDEX idx_poll_options_position (content_id, position),
+    FOREIGN KEY (content_id) REFERENCES polls (content_id) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_voters (
+    content_id INT NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (content_id, user_id),
+    FOREIGN KEY (content_id) REFERENCES polls (content_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_votes (
+    option_id INT NOT NULL,
+    user_id INT NOT NULL,
+    content_id INT NOT NULL,
+    PRIMARY KEY (option_id, user_id),
+    INDEX idx_poll_votes_jot (content_id),
+    FOREIGN KEY (option_id) REFERENCES poll_options (id) ON DELETE CASCADE,
+    FOREIGN KEY (content_id, user_id) REFERENCES poll_voters (content_id, user_id) ON DELETE CASCADE
+);
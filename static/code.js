@@ -0,0 +1,29 @@
+// static/code.js
+
+// Buttons on the code blocks of formatted jots. The blocks are highlighted
+// on the server; this only adds copying and expanding collapsed blocks. The
+// handlers are delegated, so they also work for blocks added after loading.
+document.addEventListener('click', function(event) {
+    const button = event.target.closest('.code-copy, .code-expand');
+    if (!button) {
+        return;
+    }
+    const block = button.closest('.code-block');
+
+    if (button.classList.contains('code-expand')) {
+        block.classList.add('code-expanded');
+        button.remove();
+        return;
+    }
+
+    navigator.clipboard.writeText(block.querySelector('code').textContent)
+        .then(function() {
+            button.textContent = 'Copied';
+            setTimeout(function() {
+                button.textContent = 'Copy';
+            }, 2000);
+        })
+        .catch(function(error) {
+            console.error('Copy failed:', error);
+        });
+});
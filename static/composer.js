@@ -0,0 +1,84 @@
+// static/composer.js
+
+// Show how the composer's text will look once posted. The server renders the
+// preview, so it always matches the formatting of real jots.
+document.getElementById('preview-button').addEventListener('click', function() {
+    const content = document.getElementById('content').value;
+    const preview = document.getElementById('composer-preview');
+
+    fetch('/preview', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams({ content: content })
+    })
+        .then(function(response) {
+            if (!response.ok) {
+                throw new Error('Preview failed: ' + response.status);
+            }
+            return response.text();
+        })
+        .then(function(html) {
+            // The server escapes the text and only emits its own markup
+            preview.innerHTML = html || '<p><em>Nothing to preview</em></p>';
+            preview.hidden = false;
+        })
+        .catch(function(error) {
+            console.error(error);
+        });
+});
+
+// Autosave the composer's text as the draft for the selected channel, a
+// second after the user stops typing. Emptying the composer deletes the draft.
+const composer = document.getElementById('content');
+const channelSelect = document.getElementById('channelID');
+const draftStatus = document.getElementById('draft-status');
+let draftTimer = null;
+
+function saveDraft() {
+    draftTimer = null;
+    fetch('/api/drafts', {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ channel_id: parseInt(channelSelect.value) || null, text: composer.value })
+    })
+        .then(function(response) {
+            if (!response.ok) {
+                throw new Error('Saving draft failed: ' + response.status);
+            }
+            draftStatus.textContent = composer.value.trim() ? 'Draft saved' : '';
+        })
+        .catch(function(error) {
+            draftStatus.textContent = 'Draft not saved';
+            console.error(error);
+        });
+}
+
+function scheduleDraftSave() {
+    clearTimeout(draftTimer);
+    draftTimer = setTimeout(saveDraft, 1000);
+}
+
+composer.addEventListener('input', scheduleDraftSave);
+channelSelect.addEventListener('change', scheduleDraftSave);
+
+// Posting deletes the draft on the server, so a pending save must not recreate it
+composer.form.addEventListener('submit', function() {
+    clearTimeout(draftTimer);
+});
+
+// Discard buttons in the list of drafts
+document.querySelectorAll('.draft-discard').forEach(function(button) {
+    button.addEventListener('click', function() {
+        const draft = button.closest('[data-draft-id]');
+        fetch('/api/drafts/' + draft.dataset.draftId, { method: 'DELETE' })
+            .then(function(response) {
+                if (!response.ok && response.status !== 404) {
+                    throw new Error('Deleting draft failed: ' + response.status);
+                }
+                draft.remove();
+            })
+            .catch(function(error) {
+                console.error(error);
+            });
+    });
+});
@@ -0,0 +1,11 @@
+// static/schedule.js
+
+// Publish times are entered in local time; send the browser's timezone along
+// so the server knows which instant was meant. Edit forms of scheduled jots
+// already carry the timezone their time is shown in, and keep it.
+document.querySelectorAll('input[name="timezone"]').forEach(function(input) {
+    const timezone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    if (!input.value && timezone) {
+        input.value = timezone;
+    }
+});
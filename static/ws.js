@@ -5,13 +5,171 @@ const socket = new WebSocket("ws://localhost:8080/ws");
 
 // Handle incoming messages
 socket.onmessage = function(event) {
-    const notification = event.data;
-    displayNotification(notification);
+    // Structured events are JSON objects with a "type"; anything else is a plain notification
+    let message;
+    try {
+        message = JSON.parse(event.data);
+    } catch (e) {
+        message = null;
+    }
+
+    if (message && typeof message === "object" && message.type) {
+        handleEvent(message);
+    } else {
+        displayNotification(event.data);
+    }
 };
 
+// Dispatch a structured event to the code that updates the page
+function handleEvent(event) {
+    switch (event.type) {
+        case "reactions.updated":
+            updateReactionCounts(event.jot_id, event.data);
+            break;
+        case "jot.removed":
+        case "jot.expired":
+            removeJot(event.jot_id);
+            break;
+        case "pins.updated":
+            updatePins(event.data.channel_id, event.data.pinned);
+            break;
+        case "preview.ready":
+            showLinkPreview(event.jot_id, event.data);
+            break;
+        case "poll.updated":
+            updatePollTally(event.jot_id, event.data);
+            break;
+    }
+}
+
+// Reorder the pinned jots of the channel being viewed. Newly pinned jots are
+// not on the page yet, so the page is reloaded when the set of pins changed.
+function updatePins(channelID, pinned) {
+    const container = document.querySelector('#pinned-jots[data-channel-id="' + channelID + '"]');
+    if (!container) {
+        return;
+    }
+
+    const shown = Array.from(container.querySelectorAll('[data-pin-id]'));
+    const sameSet = shown.length === pinned.length && shown.every(function(element) {
+        return pinned.indexOf(parseInt(element.dataset.pinId)) !== -1;
+    });
+    if (!sameSet) {
+        window.location.reload();
+        return;
+    }
+
+    pinned.forEach(function(jotID) {
+        container.appendChild(container.querySelector('[data-pin-id="' + jotID + '"]'));
+    });
+}
+
+// Add a link preview that was generated after the jot was shown. The markup
+// matches the "preview" template in jot_card.html.
+function showLinkPreview(jotID, preview) {
+    document.querySelectorAll('.jot[data-jot-id="' + jotID + '"]').forEach(function(jot) {
+        const text = jot.querySelector(':scope > .jot-text');
+        if (!text || jot.querySelector(':scope > .link-preview')) {
+            return;
+        }
+
+        const card = document.createElement('a');
+        card.className = 'link-preview';
+        card.href = preview.url;
+        card.rel = 'nofollow noopener';
+        card.target = '_blank';
+        if (preview.image_url) {
+            const image = document.createElement('img');
+            image.src = preview.image_url;
+            image.alt = '';
+            image.loading = 'lazy';
+            image.referrerPolicy = 'no-referrer';
+            card.appendChild(image);
+        }
+
+        const details = document.createElement('span');
+        details.className = 'link-preview-text';
+        const site = document.createElement('small');
+        site.textContent = preview.site_name;
+        const title = document.createElement('strong');
+        title.textContent = preview.title;
+        details.append(site, title);
+        if (preview.description) {
+            const description = document.createElement('span');
+            description.textContent = preview.description;
+            details.appendChild(description);
+        }
+        card.appendChild(details);
+
+        // Place the card after the jot's attachments, like the template does
+        const attachments = jot.querySelector(':scope > .jot-attachments');
+        (attachments || text).after(card);
+    });
+}
+
+// Remove a jot that was taken down by a moderator or expired, along with its controls
+function removeJot(jotID) {
+    document.querySelectorAll('[data-jot-id="' + jotID + '"]').forEach(function(element) {
+        element.remove();
+    });
+}
+
+// Update the reaction counts shown for a jot
+function updateReactionCounts(jotID, counts) {
+    for (const emoji in counts) {
+        const selector = '.reaction-count[data-jot="' + jotID + '"][data-emoji="' + emoji + '"]';
+        document.querySelectorAll(selector).forEach(function(element) {
+            element.textContent = counts[emoji];
+        });
+    }
+}
+
+// Update the results of a poll. Users who have not voted only get the number
+// of voters, and polls still showing the vote form have no counts on the
+// page, so their results stay hidden until the user votes.
+function updatePollTally(jotID, tally) {
+    document.querySelectorAll('.poll[data-poll-id="' + jotID + '"]').forEach(function(poll) {
+        poll.querySelectorAll('.poll-voters').forEach(function(element) {
+            element.textContent = tally.voters;
+        });
+        for (const optionID in tally.votes) {
+            const votes = tally.votes[optionID];
+            const percent = tally.voters > 0 ? Math.floor(votes * 100 / tally.voters) : 0;
+            poll.querySelectorAll('.poll-count[data-option-id="' + optionID + '"]').forEach(function(element) {
+                element.textContent = votes;
+            });
+            poll.querySelectorAll('.poll-bar[data-option-id="' + optionID + '"]').forEach(function(element) {
+                element.style.width = percent + '%';
+            });
+        }
+    });
+}
+
 // Display notification (this function can be customized)
 function displayNotification(message) {
+    // The home page has a notification badge with a counter
+    const notificationList = document.getElementById('notification-list');
+    if (notificationList) {
+        const newNotification = document.createElement('div');
+        newNotification.textContent = message;
+        notificationList.appendChild(newNotification);
+
+        // Update the notification count
+        const notificationCount = document.getElementById('notification-count');
+        notificationCount.textContent = parseInt(notificationCount.textContent) + 1;
+
+        // Remove the notification after 5 seconds
+        setTimeout(() => {
+            notificationList.removeChild(newNotification);
+            notificationCount.textContent = parseInt(notificationCount.textContent) - 1;
+        }, 5000);
+        return;
+    }
+
     const notificationArea = document.getElementById('notification-area');
+    if (!notificationArea) {
+        return;
+    }
     const notificationElement = document.createElement('div');
     notificationElement.className = 'notification';
     notificationElement.innerText = message;
@@ -21,4 +179,4 @@ function displayNotification(message) {
     setTimeout(() => {
         notificationArea.removeChild(notificationElement);
     }, 5000);
-}
\ No newline at end of file
+}
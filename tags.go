@@ -0,0 +1,184 @@
+// tags.go
+//
+// This file handles hashtags. Tags are extracted from jot text when the jot is
+// saved and stored in the tags and jot_tags tables so /tags/{tag} pages can be
+// served with a simple join. Trending tags are tracked in Redis with one sorted
+// set per hour; the trending panel merges the recent buckets, weighting older
+// hours less so that tags fade out as they stop being used.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tagPattern matches a hashtag that is not glued to a preceding word, so that
+// URLs with fragments or HTML entities like "&#39;" are not picked up as tags.
+var tagPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_&/])#([\p{L}_][\p{L}\p{N}_]{0,63})`)
+
+// tagNamePattern matches a whole tag name as captured by tagPattern.
+var tagNamePattern = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_]{0,63}$`)
+
+// Trending tag tuning
+const (
+	trendingBucketPrefix = "trending:tags:" // Key prefix for the hourly sorted sets
+	trendingCacheKey     = "trending:tags:current"
+	trendingWindowHours  = 24  // How many hourly buckets make up the window
+	trendingDecay        = 0.9 // Weight multiplier applied per hour of age
+	trendingCacheTTL     = time.Minute
+)
+
+// TrendingTag is a tag with its decayed usage score over the trending window.
+type TrendingTag struct {
+	Name  string
+	Score float64
+}
+
+// ExtractTags returns the distinct, lowercased hashtags found in text, in order of appearance.
+func ExtractTags(text string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, match := range tagPattern.FindAllStringSubmatch(text, -1) {
+		tag := strings.ToLower(match[2])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// IsValidTag reports whether name could have been extracted from a jot as a hashtag.
+func IsValidTag(name string) bool {
+	return tagNamePattern.MatchString(name)
+}
+
+// SaveTags extracts the hashtags from a jot's text, links them to the jot and
+// counts them towards the trending tags. Tags used in private and invite-only
+// channels are not counted, since trending is shown to everyone.
+func SaveTags(jotID int64, text string) error {
+	tags := ExtractTags(text)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// User 0 is never a channel member, so this tells whether the jot is public
+	public, err := CanViewJot(0, int(jotID))
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		// Create the tag the first time it is used; LAST_INSERT_ID(id) makes
+		// LastInsertId return the existing row's ID when it already exists
+		res, err := db.Exec("INSERT INTO tags (name) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)", tag)
+		if err != nil {
+			log.Printf("Error saving tag: %v", err)
+			return err
+		}
+		tagID, err := res.LastInsertId()
+		if err != nil {
+			log.Printf("Error getting last insert ID: %v", err)
+			return err
+		}
+
+		_, err = db.Exec("INSERT IGNORE INTO jot_tags (content_id, tag_id) VALUES (?, ?)", jotID, tagID)
+		if err != nil {
+			log.Printf("Error linking tag: %v", err)
+			return err
+		}
+
+		if public {
+			recordTrendingTag(tag)
+		}
+	}
+	return nil
+}
+
+// recordTrendingTag counts one use of tag in the current hour's bucket.
+// Failures are logged but not returned, since trending is best effort.
+func recordTrendingTag(tag string) {
+	key := trendingBucketPrefix + time.Now().UTC().Format("2006010215")
+	pipe := redisClient.TxPipeline()
+	pipe.ZIncrBy(ctx, key, 1, tag)
+	pipe.Expire(ctx, key, (trendingWindowHours+1)*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error recording trending tag: %v", err)
+	}
+}
+
+// FetchTrendingTags returns the top tags over the trending window. The merged
+// result is cached briefly so busy pages don't recompute it on every request.
+func FetchTrendingTags(limit int) ([]TrendingTag, error) {
+	exists, err := redisClient.Exists(ctx, trendingCacheKey).Result()
+	if err != nil {
+		log.Printf("Error reading trending tags: %v", err)
+		return nil, err
+	}
+
+	if exists == 0 {
+		// Weight each hourly bucket by its age so recent activity counts most
+		now := time.Now().UTC()
+		store := &redis.ZStore{Aggregate: "SUM"}
+		for hour := 0; hour < trendingWindowHours; hour++ {
+			bucket := now.Add(-time.Duration(hour) * time.Hour).Format("2006010215")
+			store.Keys = append(store.Keys, trendingBucketPrefix+bucket)
+			store.Weights = append(store.Weights, math.Pow(trendingDecay, float64(hour)))
+		}
+
+		pipe := redisClient.TxPipeline()
+		pipe.ZUnionStore(ctx, trendingCacheKey, store)
+		pipe.Expire(ctx, trendingCacheKey, trendingCacheTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Error computing trending tags: %v", err)
+			return nil, err
+		}
+	}
+
+	results, err := redisClient.ZRevRangeWithScores(ctx, trendingCacheKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		log.Printf("Error reading trending tags: %v", err)
+		return nil, err
+	}
+
+	tags := make([]TrendingTag, 0, len(results))
+	for _, z := range results {
+		tags = append(tags, TrendingTag{Name: fmt.Sprint(z.Member), Score: z.Score})
+	}
+	return tags, nil
+}
+
+// FetchJotsByTag retrieves one page of jots tagged with tag that userID may read, most recent first.
+// It fetches one extra row to report whether another page follows.
+func FetchJotsByTag(tag string, userID, limit, offset int) ([]Jot, bool, error) {
+	rows, err := db.Query(jotSelect+`
+        JOIN jot_tags ON jot_tags.content_id = content.id
+        JOIN tags ON tags.id = jot_tags.tag_id
+        WHERE tags.name = ? AND `+visibleJotsClause+`
+        ORDER BY content.created_at DESC, content.id DESC
+        LIMIT ? OFFSET ?
+    `, strings.ToLower(tag), userID, userID, limit+1, offset)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	jots, err := scanJots(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(jots) > limit
+	if hasMore {
+		jots = jots[:limit]
+	}
+	return jots, hasMore, nil
+}
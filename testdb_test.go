@@ -0,0 +1,180 @@
+// testdb_test.go
+//
+// This file provides a stand-in for the MySQL database in tests: a stub
+// driver that answers queries from a function supplied by the test, and a
+// connector wrapper that counts the statements sent to any driver, so tests
+// and benchmarks can check how many queries a code path issues.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConnector wraps a driver connector and counts every statement its
+// connections run, whether sent directly or through a prepared statement.
+type countingConnector struct {
+	driver.Connector
+	queries *int64
+}
+
+func (c countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, queries: c.queries}, nil
+}
+
+// countingConn counts the statements run on a connection. Drivers that can't
+// run a statement directly return driver.ErrSkip, and database/sql prepares
+// it instead; those are counted when the prepared statement runs.
+type countingConn struct {
+	driver.Conn
+	queries *int64
+}
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		atomic.AddInt64(c.queries, 1)
+	}
+	return rows, err
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	res, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		atomic.AddInt64(c.queries, 1)
+	}
+	return res, err
+}
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStmt{Stmt: stmt, queries: c.queries}, nil
+}
+
+// countingStmt counts the runs of a prepared statement.
+type countingStmt struct {
+	driver.Stmt
+	queries *int64
+}
+
+func (s *countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	atomic.AddInt64(s.queries, 1)
+	return s.Stmt.Exec(args)
+}
+
+func (s *countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	atomic.AddInt64(s.queries, 1)
+	return s.Stmt.Query(args)
+}
+
+// stubResponder answers a query run against the stub database with the
+// names of the result columns and the rows. Statements that are not queries
+// get a result with one affected row.
+type stubResponder func(query string, args []driver.NamedValue) (columns []string, rows [][]driver.Value)
+
+// stubConnector opens connections to a stub database answered by respond.
+type stubConnector struct {
+	respond stubResponder
+}
+
+func (c stubConnector) Connect(context.Context) (driver.Conn, error) {
+	return &stubConn{respond: c.respond}, nil
+}
+
+func (c stubConnector) Driver() driver.Driver {
+	return stubDriver{}
+}
+
+// stubDriver only exists to satisfy driver.Connector; stub databases are
+// opened with sql.OpenDB.
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("stub databases are opened with sql.OpenDB")
+}
+
+// stubConn runs every statement through its responder.
+type stubConn struct {
+	respond stubResponder
+}
+
+func (c *stubConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("the stub database does not prepare statements")
+}
+
+func (c *stubConn) Close() error { return nil }
+
+func (c *stubConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+func (c *stubConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	columns, rows := c.respond(query, args)
+	return &stubRows{columns: columns, rows: rows}, nil
+}
+
+func (c *stubConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return stubResult{}, nil
+}
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubResult struct{}
+
+func (stubResult) LastInsertId() (int64, error) { return 1, nil }
+func (stubResult) RowsAffected() (int64, error) { return 1, nil }
+
+// stubRows returns a fixed set of rows.
+type stubRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+
+func (r *stubRows) Close() error { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// useStubDB replaces the database with a stub answered by respond until the
+// test ends. It returns the number of statements run so far, which the test
+// may reset.
+func useStubDB(tb testing.TB, respond stubResponder) *int64 {
+	queries := new(int64)
+	previous := db
+	db = sql.OpenDB(countingConnector{Connector: stubConnector{respond: respond}, queries: queries})
+	tb.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+	return queries
+}
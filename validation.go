@@ -0,0 +1,102 @@
+// validation.go
+//
+// This file checks and normalizes the text of new jots before they are
+// stored. Text is converted to NFC, so visually identical jots are stored
+// identically, and stripped of control characters. Length is counted in
+// user-perceived characters (grapheme clusters, as segmented by uniseg)
+// rather than bytes or code points, so an emoji built from several code
+// points counts once. Problems are reported per form field, so the composer
+// can show them next to the field they concern.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Limits for the text of a jot
+const (
+	maxJotLength   = 2000 // Characters (grapheme clusters)
+	maxJotLinks    = 5
+	maxJotMentions = 10
+)
+
+// ValidationError is returned when the fields of a jot are invalid. Fields
+// maps each rejected form field to a message meant to be shown next to it.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = e.Fields[name]
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records a problem with a field, keeping the first one reported for it.
+func (e *ValidationError) add(field, message string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	if _, ok := e.Fields[field]; !ok {
+		e.Fields[field] = message
+	}
+}
+
+// ValidateJotText normalizes the text of a new jot and checks it against the
+// limits. It returns the text to store, or a *ValidationError for the
+// "content" field. Empty text is only accepted when allowEmpty is set, as
+// for plain re-jots.
+func ValidateJotText(content string, allowEmpty bool) (string, error) {
+	content = NormalizeText(content)
+
+	var invalid ValidationError
+	if content == "" && !allowEmpty {
+		invalid.add("content", "Write something before posting")
+	}
+	if length := uniseg.GraphemeClusterCount(content); length > maxJotLength {
+		invalid.add("content", fmt.Sprintf("Jots can be at most %d characters long; this one has %d", maxJotLength, length))
+	}
+	if links := len(linkPattern.FindAllString(content, -1)); links > maxJotLinks {
+		invalid.add("content", fmt.Sprintf("Jots can contain at most %d links; this one has %d", maxJotLinks, links))
+	}
+	if mentions := len(ExtractMentions(content)); mentions > maxJotMentions {
+		invalid.add("content", fmt.Sprintf("Jots can mention at most %d people; this one mentions %d", maxJotMentions, mentions))
+	}
+
+	if len(invalid.Fields) > 0 {
+		return "", &invalid
+	}
+	return content, nil
+}
+
+// NormalizeText cleans up user supplied text: invalid UTF-8 and control
+// characters other than newlines and tabs are removed, line endings become
+// "\n", the text is converted to Unicode NFC and surrounding whitespace is
+// trimmed.
+func NormalizeText(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.TrimSpace(norm.NFC.String(text))
+}
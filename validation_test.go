@@ -0,0 +1,66 @@
+// validation_test.go
+//
+// This file tests the normalization and limits applied to the text of new jots.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateJotText(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"trims whitespace", "  hello  ", "hello"},
+		{"converts to NFC", "Cafe\u0301", "Caf\u00e9"},
+		{"normalizes line endings", "one\r\ntwo\rthree", "one\ntwo\nthree"},
+		{"drops control characters", "bell\a and null\x00", "bell and null"},
+		{"keeps tabs", "a\tb", "a\tb"},
+		{"drops invalid UTF-8", "bad \xff byte", "bad  byte"},
+		{"at the limit", strings.Repeat("x", maxJotLength), strings.Repeat("x", maxJotLength)},
+		// Each of these is one user-perceived character made of several code points
+		{"family emoji", strings.Repeat("👨‍👩‍👧", maxJotLength), strings.Repeat("👨‍👩‍👧", maxJotLength)},
+		{"flags", strings.Repeat("🇩🇪", maxJotLength), strings.Repeat("🇩🇪", maxJotLength)},
+		{"skin tones", strings.Repeat("👍🏽", maxJotLength), strings.Repeat("👍🏽", maxJotLength)},
+		{"Hangul syllables", strings.Repeat("각", maxJotLength), strings.Repeat("각", maxJotLength)},
+	}
+	for _, tt := range tests {
+		got, err := ValidateJotText(tt.text, false)
+		if err != nil {
+			t.Errorf("%s: returned %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: returned %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateJotTextRejects(t *testing.T) {
+	tests := []struct {
+		name, text string
+	}{
+		{"empty", ""},
+		{"only whitespace and control characters", " \t\x00\n "},
+		{"too long", strings.Repeat("x", maxJotLength+1)},
+		{"too many emoji", strings.Repeat("👍🏽", maxJotLength+1)},
+		{"too many links", strings.Repeat("https://example.com ", maxJotLinks+1)},
+		{"too many mentions", "@a1 @a2 @a3 @a4 @a5 @a6 @a7 @a8 @a9 @a10 @a11"},
+	}
+	for _, tt := range tests {
+		_, err := ValidateJotText(tt.text, false)
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: returned %v, want a *ValidationError", tt.name, err)
+		} else if validationErr.Fields["content"] == "" {
+			t.Errorf("%s: no message for the content field", tt.name)
+		}
+	}
+}
+
+func TestValidateJotTextAllowEmpty(t *testing.T) {
+	got, err := ValidateJotText("  ", true)
+	if err != nil || got != "" {
+		t.Errorf("returned %q, %v; want an empty text accepted", got, err)
+	}
+}